@@ -0,0 +1,340 @@
+package resh
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type AccessLogFormat int
+
+const (
+	LogCommon   AccessLogFormat = iota // NCSA Common Log Format
+	LogCombined                        // Common Log Format with Referer and User-Agent
+	LogJSON                            // JSON lines
+)
+
+var (
+	AccessLogQueue  = 4096 // entries are dropped if the writer falls behind by this many
+	requestIDPrefix = func() string {
+		var b [6]byte
+		rand.Read(b[:])
+		return hex.EncodeToString(b[:])
+	}()
+	requestIDSeq atomic.Uint64
+)
+
+// AccessEntry is a log entry of an HTTP request, a RESP command or a WebSocket session.
+type AccessEntry struct {
+	Time       time.Time     `json:"time"`
+	Proto      string        `json:"proto"` // HTTP/1.x, HTTP/2.0 or RESP, WebSocket sessions are logged as their upgrade requests with 101
+	RemoteAddr string        `json:"remote_addr"`
+	ClientIP   string        `json:"client_ip,omitempty"` // HTTP.ClientIP if it is not the peer
+	Method     string        `json:"method"`              // HTTP method or RESP command
+	Path       string        `json:"path,omitempty"`      // raw request target
+	Host       string        `json:"host,omitempty"`
+	Status     int           `json:"status,omitempty"` // HTTP status
+	Reply      string        `json:"reply,omitempty"`  // RESP reply type, the last quoted field in CLF
+	BytesIn    int           `json:"bytes_in"`
+	BytesOut   int           `json:"bytes_out"`
+	Latency    time.Duration `json:"latency_ns"` // until the response is flushed
+	RequestID  string        `json:"request_id,omitempty"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+
+	out0   int64 // output offset when the response started
+	mark   int64 // output offset when the response ended
+	queued atomic.Bool
+}
+
+// AccessLog writes entries in a separate goroutine so the loop never blocks.
+type AccessLog struct {
+	Format  AccessLogFormat
+	w       io.Writer
+	mu      sync.RWMutex
+	ch      chan *AccessEntry
+	closed  bool
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+func NewAccessLog(w io.Writer, format AccessLogFormat) *AccessLog {
+	l := &AccessLog{
+		Format: format,
+		w:      w,
+		ch:     make(chan *AccessEntry, AccessLogQueue),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Dropped returns the number of entries dropped because the queue was full.
+func (l *AccessLog) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// Close flushes pending entries and stops the writer.
+func (l *AccessLog) Close() {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.ch)
+	}
+	l.mu.Unlock()
+	<-l.done
+}
+
+func (l *AccessLog) Log(e *AccessEntry) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.ch <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+func (l *AccessLog) run() {
+	defer close(l.done)
+	w := bufio.NewWriterSize(l.w, 64*1024)
+	var buf []byte
+	for e := range l.ch {
+		buf = l.appendEntry(buf[:0], e)
+		w.Write(buf)
+		if len(l.ch) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+}
+
+func (l *AccessLog) appendEntry(b []byte, e *AccessEntry) []byte {
+	if l.Format == LogJSON {
+		j, _ := json.Marshal(e)
+		return append(j, '\n')
+	}
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	if e.ClientIP != "" {
+		host = e.ClientIP
+	}
+	b = append(append(b, host...), " - - ["...)
+	b = e.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(append(b, "] \""...), clfEscape(e.Method)...)
+	if e.Path != "" {
+		b = append(append(b, ' '), clfEscape(e.Path)...)
+	}
+	b = append(append(append(b, ' '), e.Proto...), "\" "...)
+	if e.Status > 0 {
+		b = strconv.AppendInt(b, int64(e.Status), 10)
+	} else {
+		b = append(b, '-')
+	}
+	b = strconv.AppendInt(append(b, ' '), int64(e.BytesOut), 10)
+	if l.Format == LogCombined {
+		b = append(append(append(b, " \""...), clfEscape(e.Referer)...), "\" \""...)
+		b = append(append(b, clfEscape(e.UserAgent)...), '"')
+	}
+	if e.Reply != "" {
+		b = append(append(append(b, " \""...), e.Reply...), '"')
+	}
+	return append(b, '\n')
+}
+
+// clfEscape escapes quotes, backslashes and control bytes as \xHH so fields
+// can't forge lines or break quoting.
+func clfEscape(s string) string {
+	if s == "" {
+		return "-"
+	}
+	i := 0
+	for ; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == 0x7f || c == '"' || c == '\\' {
+			break
+		}
+	}
+	if i == len(s) {
+		return s
+	}
+	const digits = "0123456789abcdef"
+	b := append(make([]byte, 0, len(s)+8), s[:i]...)
+	for ; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			b = append(b, '\\', 'x', digits[c>>4], digits[c&15])
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// newAccessEntry starts an entry for a request received on c.
+func (ln *Listener) newAccessEntry(c *Conn, proto string, bytesIn int) *AccessEntry {
+	e := &AccessEntry{
+		Time:       time.Now(),
+		Proto:      proto,
+		RemoteAddr: c.RemoteAddr().String(),
+		BytesIn:    bytesIn,
+	}
+	c.spinLock()
+	e.out0 = c.flushed + int64(len(c.out))
+	c.spinUnlock()
+	return e
+}
+
+func newRequestID() string {
+	return requestIDPrefix + strconv.FormatUint(requestIDSeq.Add(1), 36)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c <= ' ' || c >= 0x7f || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// logHTTP starts the access log entry of the request and assigns its request ID.
+func (ln *Listener) logHTTP(r *HTTP) {
+	if ln.AccessLog == nil {
+		return
+	}
+	if r.reqID = r.GetHeader("x-request-id"); !validRequestID(r.reqID) {
+		r.reqID = newRequestID()
+	} else {
+		r.reqID = strings.Clone(r.reqID)
+	}
+	r.addHeader("X-Request-ID", r.reqID)
+
+	e := ln.newAccessEntry(r.Conn, r.Proto(), len(r.data))
+	e.Method = strings.Clone(r.Method())
+	e.Path = r.target
+	e.Host = strings.Clone(r.Host)
+	e.Referer = strings.Clone(r.GetHeader("referer"))
+	e.UserAgent = strings.Clone(r.GetHeader("user-agent"))
+	e.RequestID = r.reqID
+	if len(ln.trustedProxies) > 0 {
+		if ip, _, _ := net.SplitHostPort(e.RemoteAddr); ip != r.ClientIP() {
+			e.ClientIP = r.ClientIP()
+		}
+	}
+	r.log = e
+	if r.h2 != nil {
+		r.h2.log = e
+	}
+}
+
+// RequestID returns the X-Request-ID of the request, which is propagated from
+// the client or generated. It is empty if Listener.AccessLog is not set.
+func (r *HTTP) RequestID() string {
+	return r.reqID
+}
+
+// logRedis starts the access log entry of the command.
+func (ln *Listener) logRedis(r *Redis) {
+	if ln.AccessLog == nil {
+		return
+	}
+	e := ln.newAccessEntry(r.Conn, "RESP", int(r.read))
+	cmd := r.Get(0)
+	if len(cmd) > 32 {
+		cmd = cmd[:32]
+	}
+	e.Method = strings.ToUpper(string(cmd))
+	r.log = e
+}
+
+// endLog queues the entry of the command if a reply has been written or force is true.
+func (r *Redis) endLog(force bool) {
+	e := r.log
+	if e == nil {
+		return
+	}
+	c := r.Conn
+	c.spinLock()
+	if end := c.flushed + int64(len(c.out)); (end > e.out0 || force) && e.queued.CompareAndSwap(false, true) {
+		if i := e.out0 - c.flushed; i >= 0 && i < int64(len(c.out)) {
+			switch c.out[i] {
+			case '+':
+				e.Reply = "simple"
+			case '-':
+				e.Reply = "error"
+			case ':':
+				e.Reply = "integer"
+			case '$':
+				e.Reply = "bulk"
+			case '*':
+				e.Reply = "array"
+			}
+		}
+		e.BytesOut = int(end - e.out0)
+		c.logAfterFlush(e)
+	}
+	c.spinUnlock()
+}
+
+// endLog queues the entry of the HTTP/1 response.
+func (r *HTTP) endLog() {
+	e := r.log
+	if e == nil {
+		return
+	}
+	r.log = nil
+	if r.h2 != nil {
+		return // logged when the stream ends
+	}
+	c := r.Conn
+	c.spinLock()
+	e.BytesOut = int(c.flushed + int64(len(c.out)) - e.out0)
+	c.logAfterFlush(e)
+	c.spinUnlock()
+}
+
+// logAfterFlush queues e until all outputs so far are flushed, lock must be held.
+func (c *Conn) logAfterFlush(e *AccessEntry) {
+	e.mark = c.flushed + int64(len(c.out))
+	c.logs = append(c.logs, e)
+}
+
+// flushedLogs accounts n written bytes and returns entries whose responses are flushed, lock must be held.
+func (c *Conn) flushedLogs(n int) (res []*AccessEntry) {
+	c.flushed += int64(n)
+	i := 0
+	for i < len(c.logs) && c.logs[i].mark <= c.flushed {
+		i++
+	}
+	if i > 0 {
+		res = c.logs[:i:i]
+		c.logs = c.logs[i:]
+	}
+	return res
+}
+
+func (ln *Listener) emitLogs(logs []*AccessEntry) {
+	now := time.Now()
+	for _, e := range logs {
+		e.Latency = now.Sub(e.Time)
+		ln.AccessLog.Log(e)
+	}
+}
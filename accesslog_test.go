@@ -0,0 +1,70 @@
+package resh
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testConn returns a connection of a listener configured like Serve does.
+func testConn(ln *Listener) *Conn {
+	ln.HTTPMaxHeaders, ln.HTTPMaxHeaderBytes = 100, 64*1024
+	return &Conn{ln: ln, sa: &syscall.SockaddrInet4{Port: 1234, Addr: [4]byte{10, 0, 0, 1}}}
+}
+
+func TestAccessLogEscape(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string // in the CLF line
+	}{
+		{
+			"GET /a%0d%0a10.0.0.9%20-%20-%20x HTTP/1.1\r\nHost: x\r\nUser-Agent: u\"v\r\n\r\n",
+			`"GET /a%0d%0a10.0.0.9%20-%20-%20x HTTP/1.1" - 0 "-" "u\"v"`,
+		},
+		{
+			"*2\r\n$13\r\nGET\r\n1.2.3.4\x00\r\n$1\r\nk\r\n",
+			`"GET\x0d\x0a1.2.3.4\x00 RESP" - 0 "-" "-"`,
+		},
+	} {
+		ln := &Listener{AccessLog: &AccessLog{Format: LogCombined}}
+		c := testConn(ln)
+		var srs serverReadState
+		if err := srs.process(ln, []byte(tc.in)); err != nil {
+			t.Fatalf("%q: %v", tc.in, err)
+		}
+		var e *AccessEntry
+		if r := srs.http; r != nil {
+			r.Conn = c
+			ln.logHTTP(r)
+			e = r.log
+		} else {
+			srs.redis.Conn = c
+			ln.logRedis(srs.redis)
+			e = srs.redis.log
+		}
+		e.Time = time.Time{}
+		line := string(ln.AccessLog.appendEntry(nil, e))
+		if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+			t.Errorf("%q: forged lines %q", tc.in, line)
+		}
+		if !strings.Contains(line, tc.want) {
+			t.Errorf("%q: got %q, want %q in it", tc.in, line, tc.want)
+		}
+	}
+}
+
+func TestCLFEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"":          "-",
+		"plain":     "plain",
+		`a"b\c`:     `a\"b\\c`,
+		"a\r\nb\tc": `a\x0d\x0ab\x09c`,
+		"\x7f\x1f":  `\x7f\x1f`,
+		"café":      "café",
+	} {
+		if got := clfEscape(in); got != want {
+			t.Errorf("clfEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package resh
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator resolves the identity of a request, see Auth.
+type Authenticator interface {
+	// Authenticate returns the identity of the request, or nil and the
+	// challenge sent in WWW-Authenticate if the request is not authenticated.
+	Authenticate(r *HTTP) (identity any, challenge string)
+}
+
+// SlowAuthenticator is an Authenticator too slow to run in the loop for some
+// requests, like BasicAuth comparing bcrypt hashes.
+type SlowAuthenticator interface {
+	Authenticator
+	// Slow reports whether authenticating the request blocks, Auth then
+	// authenticates it in a new goroutine and calls the handler in the loop.
+	Slow(r *HTTP) bool
+}
+
+// Auth returns a handler which calls handler if any of auths authenticates the
+// request, whose identity can be read by HTTP.Identity. Otherwise 401 is
+// responded with challenges of all auths.
+func Auth(handler func(*HTTP) bool, auths ...Authenticator) func(*HTTP) bool {
+	return func(r *HTTP) bool {
+		for _, a := range auths {
+			if sa, ok := a.(SlowAuthenticator); ok && sa.Slow(r) {
+				go func() {
+					id, challenges := authenticate(r, auths)
+					r.Conn.runInLoop(func() {
+						if !authorized(r, handler, id, challenges) {
+							r.Conn.Close()
+						}
+					})
+				}()
+				return true
+			}
+		}
+		id, challenges := authenticate(r, auths)
+		return authorized(r, handler, id, challenges)
+	}
+}
+
+// authenticate returns the identity resolved by the first of auths, or challenges of all.
+func authenticate(r *HTTP, auths []Authenticator) (any, []string) {
+	var challenges []string
+	for _, a := range auths {
+		id, challenge := a.Authenticate(r)
+		if id != nil {
+			return id, nil
+		}
+		challenges = append(challenges, challenge)
+	}
+	return nil, challenges
+}
+
+func authorized(r *HTTP, handler func(*HTTP) bool, id any, challenges []string) bool {
+	if id != nil {
+		r.identity = id
+		return handler(r)
+	}
+	r.BytesHeaders(401, "", http.Header{"WWW-Authenticate": challenges}, []byte(http.StatusText(401))).Flush()
+	return true
+}
+
+// Identity returns the identity resolved by Auth, or nil.
+func (r *HTTP) Identity() any {
+	return r.identity
+}
+
+// authParam returns the credentials in the Authorization header if its scheme matches.
+func (r *HTTP) authParam(scheme string) (string, bool) {
+	auth := r.GetHeader("authorization")
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) || auth[len(scheme)] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(scheme)+1:]), true
+}
+
+func quoteRealm(scheme, realm string) string {
+	if realm == "" {
+		realm = "resh"
+	}
+	return scheme + ` realm="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(realm) + `"`
+}
+
+// BasicAuth authenticates users by the Basic scheme, the identity is the user name.
+type BasicAuth struct {
+	Realm string
+	// Users maps names to plain passwords or bcrypt hashes ("$2a$", "$2b$" or "$2y$").
+	// It must not be changed once in use.
+	Users map[string]string
+
+	mu        sync.Mutex
+	verified  map[string][32]byte // bcrypt hash -> sha256 of the matching password
+	dummyOnce sync.Once
+	dummy     string // bcrypt hash compared with passwords of unknown users
+}
+
+// ParseHtpasswd parses 'user:hash' lines of an htpasswd file, only bcrypt hashes are supported.
+func ParseHtpasswd(data []byte) (map[string]string, error) {
+	users := map[string]string{}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		user, hash, ok := bytes.Cut(line, []byte(":"))
+		if !ok || len(user) == 0 {
+			return nil, fmt.Errorf("htpasswd line %d: invalid entry", i+1)
+		}
+		if !isBcrypt(string(hash)) {
+			return nil, fmt.Errorf("htpasswd line %d: %s is not a bcrypt hash", i+1, user)
+		}
+		users[string(user)] = string(hash)
+	}
+	return users, nil
+}
+
+func isBcrypt(h string) bool {
+	return strings.HasPrefix(h, "$2a$") || strings.HasPrefix(h, "$2b$") || strings.HasPrefix(h, "$2y$")
+}
+
+func (a *BasicAuth) credentials(r *HTTP) (user, pass string, ok bool) {
+	cred, ok := r.authParam("Basic")
+	if !ok {
+		return "", "", false
+	}
+	dec, err := base64.StdEncoding.DecodeString(cred)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(dec), ":")
+}
+
+func (a *BasicAuth) Authenticate(r *HTTP) (any, string) {
+	user, pass, ok := a.credentials(r)
+	if !ok || !a.verify(user, pass) {
+		return nil, quoteRealm("Basic", a.Realm) + `, charset="UTF-8"`
+	}
+	return user, ""
+}
+
+// Slow reports whether the password needs a bcrypt comparison, which is the
+// case for unknown users too.
+func (a *BasicAuth) Slow(r *HTTP) bool {
+	user, pass, ok := a.credentials(r)
+	if !ok {
+		return false
+	}
+	want, ok := a.Users[user]
+	if !ok {
+		return true
+	}
+	if !isBcrypt(want) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(pass))
+	a.mu.Lock()
+	prev, cached := a.verified[want]
+	a.mu.Unlock()
+	return !cached || subtle.ConstantTimeCompare(prev[:], sum[:]) != 1
+}
+
+// dummyHash returns a bcrypt hash of a random password at the cost of Users,
+// or "" if there are no bcrypt hashes.
+func (a *BasicAuth) dummyHash() string {
+	a.dummyOnce.Do(func() {
+		for _, h := range a.Users {
+			if cost, err := bcrypt.Cost([]byte(h)); err == nil {
+				var pass [16]byte
+				rand.Read(pass[:])
+				dummy, _ := bcrypt.GenerateFromPassword(pass[:], cost)
+				a.dummy = string(dummy)
+				break
+			}
+		}
+	})
+	return a.dummy
+}
+
+// verify compares passwords in constant time. Unknown users are compared with
+// a dummy hash so they take as long as known ones. bcrypt is slow, so digests
+// of verified passwords are remembered, wrong passwords still cost a bcrypt
+// comparison.
+func (a *BasicAuth) verify(user, pass string) bool {
+	want, ok := a.Users[user]
+	if !ok {
+		want = a.dummyHash()
+	}
+	sum := sha256.Sum256([]byte(pass))
+	if !isBcrypt(want) {
+		wantSum := sha256.Sum256([]byte(want))
+		return subtle.ConstantTimeCompare(wantSum[:], sum[:]) == 1 && ok
+	}
+	a.mu.Lock()
+	prev, cached := a.verified[want]
+	a.mu.Unlock()
+	if cached && subtle.ConstantTimeCompare(prev[:], sum[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(want), []byte(pass)) != nil || !ok {
+		return false
+	}
+	a.mu.Lock()
+	if a.verified == nil {
+		a.verified = map[string][32]byte{}
+	}
+	a.verified[want] = sum
+	a.mu.Unlock()
+	return true
+}
+
+// BearerAuth authenticates requests by the Bearer scheme.
+type BearerAuth struct {
+	Realm string
+	// Validate returns the identity of the token, or an error if it is invalid.
+	Validate func(token string) (identity any, err error)
+}
+
+func (a *BearerAuth) Authenticate(r *HTTP) (any, string) {
+	challenge := quoteRealm("Bearer", a.Realm)
+	token, ok := r.authParam("Bearer")
+	if !ok || token == "" {
+		return nil, challenge
+	}
+	id, err := a.Validate(token)
+	if err != nil || id == nil {
+		return nil, challenge + `, error="invalid_token"`
+	}
+	return id, ""
+}
+
+// HMACAuth authenticates requests signed by SignHMAC:
+//
+//	Authorization: HMAC-SHA256 key=<key id>, ts=<unix seconds>, nonce=<nonce>, sig=<hex>
+//
+// The signature covers the method, the unescaped path with the raw query, ts,
+// nonce and the sha256 of the body. Requests older than MaxSkew or reusing a
+// nonce within MaxSkew are rejected.
+type HMACAuth struct {
+	Realm string
+	// Secret returns the secret and the identity of the key id, or nil if unknown.
+	Secret  func(keyID string) (secret []byte, identity any)
+	MaxSkew time.Duration // 0 means 5 minutes
+
+	mu     sync.Mutex
+	nonces map[string]int64 // nonce -> expiry in unix seconds
+	pruned int64
+}
+
+func hmacSignature(secret []byte, method, uri, ts, nonce string, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(method + "\n" + uri + "\n" + ts + "\n" + nonce + "\n" + hex.EncodeToString(bodySum[:])))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// SignHMAC returns the Authorization header of the request for HMACAuth,
+// uri is the unescaped path with the raw query like "/a b?q=%20".
+func SignHMAC(keyID string, secret []byte, method, uri string, body []byte) string {
+	var rnd [12]byte
+	rand.Read(rnd[:])
+	ts, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(rnd[:])
+	return "HMAC-SHA256 key=" + keyID + ", ts=" + ts + ", nonce=" + nonce + ", sig=" + hmacSignature(secret, method, uri, ts, nonce, body)
+}
+
+func (a *HMACAuth) Authenticate(r *HTTP) (any, string) {
+	challenge := quoteRealm("HMAC-SHA256", a.Realm)
+	cred, ok := r.authParam("HMAC-SHA256")
+	if !ok {
+		return nil, challenge
+	}
+	params := map[string]string{}
+	for _, kv := range strings.Split(cred, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		params[k] = v
+	}
+	secret, id := a.Secret(params["key"])
+	if secret == nil || id == nil || params["nonce"] == "" {
+		return nil, challenge
+	}
+
+	skew := int64(a.MaxSkew / time.Second)
+	if skew <= 0 {
+		skew = 300
+	}
+	now := time.Now().Unix()
+	ts, err := strconv.ParseInt(params["ts"], 10, 64)
+	if err != nil || ts < now-skew || ts > now+skew {
+		return nil, challenge + `, error="stale request"`
+	}
+
+	uri := r.Path
+	if q := r.RawQuery(); q != "" {
+		uri += "?" + q
+	}
+	sig := hmacSignature(secret, r.Method(), uri, params["ts"], params["nonce"], r.Body())
+	if !hmac.Equal([]byte(sig), []byte(params["sig"])) {
+		return nil, challenge
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.nonces == nil {
+		a.nonces = map[string]int64{}
+	}
+	if now-a.pruned > skew {
+		for n, exp := range a.nonces {
+			if exp < now {
+				delete(a.nonces, n)
+			}
+		}
+		a.pruned = now
+	}
+	if _, replayed := a.nonces[params["nonce"]]; replayed {
+		return nil, challenge + `, error="replayed request"`
+	}
+	a.nonces[params["nonce"]] = ts + skew
+	return id, ""
+}
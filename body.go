@@ -0,0 +1,292 @@
+package resh
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	StreamMaxBytes   = 1 << 30     // default limit of streamed request bodies
+	SpoolBufferBytes = 1024 * 1024 // SpoolBody pauses reading when this many bytes are waiting for the disk
+)
+
+var (
+	errBodyAborted = fmt.Errorf("request body aborted")
+	errHTTPBody    = fmt.Errorf("http body follows") // headers parsed, Listener.OnHTTPBody decides how to read the body
+)
+
+// BodyStream receives a request body in pieces instead of buffering it, see Listener.OnHTTPBody.
+type BodyStream struct {
+	// MaxBytes limits the body, 0 means StreamMaxBytes. Larger bodies get 413.
+	MaxBytes int
+	// OnData is called in the loop goroutine with each piece of the body, p is
+	// only valid during the call. OnData(nil, err) marks the end, err is nil if
+	// the body is complete. Returning false stops reading from the client until
+	// HTTP.ResumeBody is called, pieces already received may still be delivered.
+	OnData func(p []byte, err error) (more bool)
+
+	read int
+	done bool
+}
+
+func (bs *BodyStream) maxBytes() int {
+	if bs.MaxBytes > 0 {
+		return bs.MaxBytes
+	}
+	return StreamMaxBytes
+}
+
+func (bs *BodyStream) end(err error) {
+	if !bs.done {
+		bs.done = true
+		bs.OnData(nil, err)
+	}
+}
+
+// Pause states of a streamed body, a resume may arrive before the loop pauses.
+const (
+	bodyReading = iota
+	bodyPaused
+	bodyResumed
+)
+
+// ResumeBody resumes reading the request body paused by BodyStream.OnData.
+func (r *HTTP) ResumeBody() {
+	if s := r.h2; s != nil {
+		s.resumeBody()
+		return
+	}
+	c := r.Conn
+	if c.bodyPause.CompareAndSwap(bodyPaused, bodyReading) {
+		c.Flush() // events are updated by writeConn in the loop
+	} else {
+		c.bodyPause.CompareAndSwap(bodyReading, bodyResumed)
+	}
+}
+
+// startBody streams the body of the HTTP/1 request whose headers are in c.in,
+// it returns false if the request is rejected.
+func (ln *Listener) startBody(c *Conn, req *HTTP, bs *BodyStream) bool {
+	if int(req.bodyLen) > bs.maxBytes() {
+		ln.httpError(c, &httpError{413, fmt.Errorf("request body too large: %db > %db", req.bodyLen, bs.maxBytes())})
+		return false
+	}
+	if req.expect100 {
+		req.expect100 = false
+		ln.expectContinue(c, req)
+		if c.closing || c.closed.Load() == 1 {
+			return false
+		}
+	}
+
+	c.spinLock()
+	// The request keeps the old buffer, the body and following inputs move to a new one.
+	req.data = c.in[:req.hdrLen]
+	c.in = append([]byte{}, c.in[req.hdrLen:]...)
+	c.spinUnlock()
+	c.srs.stage, c.srs.body, c.srs.remain = 10, bs, int(req.bodyLen)
+	c.bodyPause.Store(bodyReading)
+
+	req.bodyLen = 0
+	c.async.Store(req)
+	ln.logHTTP(req)
+	if req.log != nil {
+		req.log.BytesIn += c.srs.remain
+	}
+	if !ln.OnHTTP(req) {
+		ln.closeConnWithError(c, "", nil)
+		return false
+	}
+	return true
+}
+
+// readBody passes the streamed body in c.in to OnData, it returns true once the body is complete.
+func (ln *Listener) readBody(c *Conn) bool {
+	s := &c.srs
+	c.spinLock()
+	in := c.in
+	c.spinUnlock()
+	if len(in) > s.remain {
+		in = in[:s.remain]
+	}
+	more := true
+	if len(in) > 0 {
+		s.body.read += len(in)
+		more = s.body.OnData(in, nil)
+		s.remain -= len(in)
+		c.spinLock()
+		c.in = c.in[:copy(c.in, c.in[len(in):])]
+		c.spinUnlock()
+	}
+	if s.remain == 0 {
+		s.body.end(nil)
+		return true
+	}
+	if !more && !c.bodyPause.CompareAndSwap(bodyResumed, bodyReading) {
+		c.bodyPause.Store(bodyPaused)
+		ln.modReadWrite(c)
+	}
+	return false
+}
+
+// readPaused reports whether the request body is paused, or the next HTTP/1
+// request waits for the response being written by another goroutine.
+func (c *Conn) readPaused() bool {
+	if c.bodyPause.Load() == bodyPaused {
+		return true
+	}
+	return c.async.Load() != nil && c.srs.stage != 10 && c.ws == nil && c.h2 == nil
+}
+
+// modRead and modReadWrite update events of c, reading is stopped while the request body is paused.
+func (ln *Listener) modRead(c *Conn) {
+	if c.readPaused() {
+		ln.poll.ModNone(c.fd)
+	} else {
+		ln.poll.ModRead(c.fd)
+	}
+}
+
+func (ln *Listener) modReadWrite(c *Conn) {
+	if c.readPaused() {
+		ln.poll.ModWrite(c.fd)
+	} else {
+		ln.poll.ModReadWrite(c.fd)
+	}
+}
+
+// bodyData passes DATA of the streamed body to OnData, the stream window is
+// not restored while paused.
+func (h *h2Conn) bodyData(s *h2Stream, p []byte, size int, endStream bool) error {
+	bs := s.bs
+	if bs.read += len(p); bs.read > bs.maxBytes() {
+		h.rst(s.id, h2ErrCancel)
+		bs.end(&httpError{413, fmt.Errorf("request body too large: %db", bs.read)})
+		return nil
+	}
+	more := len(p) == 0 || bs.OnData(p, nil)
+	if endStream {
+		s.ready = true
+		bs.end(nil)
+		return nil
+	}
+	h.mu.Lock()
+	switch {
+	case s.bodyPause == bodyResumed:
+		s.bodyPause = bodyReading
+	case !more:
+		s.bodyPause = bodyPaused // only ResumeBody unpauses
+	}
+	if s.bodyPause == bodyPaused {
+		s.unacked += size
+		size = 0
+	}
+	h.mu.Unlock()
+	if size > 0 {
+		h.windowUpdate(s.id, size)
+	}
+	return nil
+}
+
+func (s *h2Stream) resumeBody() {
+	h := s.h
+	h.mu.Lock()
+	n := 0
+	if s.bodyPause == bodyPaused {
+		n, s.unacked = s.unacked, 0
+		s.bodyPause = bodyReading
+	} else {
+		s.bodyPause = bodyResumed
+	}
+	reset := s.reset
+	h.mu.Unlock()
+	if n > 0 && !reset {
+		h.windowUpdate(s.id, n)
+		h.c.Flush()
+	}
+}
+
+// abortBodies ends streamed bodies of unfinished streams after the connection is closed.
+func (h *h2Conn) abortBodies() {
+	h.mu.Lock()
+	var bss []*BodyStream
+	for _, s := range h.streams {
+		if s.bs != nil && !s.ready {
+			bss = append(bss, s.bs)
+		}
+	}
+	h.mu.Unlock()
+	for _, bs := range bss {
+		bs.end(errBodyAborted)
+	}
+}
+
+// SpoolBody returns a BodyStream writing the body into a temporary file in dir,
+// the file is written by a separate goroutine so the loop never blocks on disk.
+// done is called with the file seeked to the start once the body is complete,
+// the caller should close and remove it. If an error occurs, the file is
+// removed and done is called with the error.
+func (r *HTTP) SpoolBody(dir string, maxBytes int, done func(f *os.File, err error)) *BodyStream {
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	var queue [][]byte
+	var queued int
+	var paused, end bool
+	var endErr error
+
+	bs := &BodyStream{MaxBytes: maxBytes}
+	bs.OnData = func(p []byte, err error) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		defer cond.Signal()
+		if p == nil {
+			end, endErr = true, err
+			return true
+		}
+		queue = append(queue, append([]byte{}, p...))
+		queued += len(p)
+		if queued >= SpoolBufferBytes {
+			paused = true // cleared by the writer once the queue is empty
+		}
+		return !paused
+	}
+	go func() {
+		f, err := os.CreateTemp(dir, "resh-body-*")
+		mu.Lock()
+		for {
+			for len(queue) == 0 && !end {
+				cond.Wait()
+			}
+			if len(queue) == 0 {
+				break
+			}
+			p := queue[0]
+			queue = queue[1:]
+			mu.Unlock()
+			if err == nil {
+				_, err = f.Write(p)
+			}
+			mu.Lock()
+			if queued -= len(p); queued == 0 && paused {
+				paused = false
+				r.ResumeBody()
+			}
+		}
+		if err == nil {
+			err = endErr
+		}
+		mu.Unlock()
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil && f != nil {
+			f.Close()
+			os.Remove(f.Name())
+			f = nil
+		}
+		done(f, err)
+	}()
+	return bs
+}
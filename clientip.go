@@ -0,0 +1,111 @@
+package resh
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies parses Listener.TrustedProxies, bare IPs are single hosts.
+func parseTrustedProxies(list []string) []netip.Prefix {
+	var res []netip.Prefix
+	for _, s := range list {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				panic("invalid trusted proxy " + s)
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		res = append(res, p.Masked())
+	}
+	return res
+}
+
+func (ln *Listener) trustedProxy(a netip.Addr) bool {
+	for _, p := range ln.trustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client. If the peer is one of
+// Listener.TrustedProxies, X-Forwarded-For, X-Real-IP or Forwarded (RFC 7239),
+// whichever is found first, is walked from right to left, and the first hop
+// not trusted is returned. A malformed hop stops the walk at the proxy which
+// added it. Use it as the key of rate limiters.
+func (r *HTTP) ClientIP() string {
+	if r.clientIP == "" {
+		r.clientIP = r.resolveClientIP()
+	}
+	return r.clientIP
+}
+
+func (r *HTTP) resolveClientIP() string {
+	addr := r.Conn.RemoteAddr()
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+	ip := ta.AddrPort().Addr().Unmap()
+	if !r.Conn.ln.trustedProxy(ip) {
+		return ip.String()
+	}
+
+	var hops []string
+	if v := r.HeaderValues("x-forwarded-for"); len(v) > 0 {
+		hops = strings.Split(strings.Join(v, ","), ",")
+	} else if v := r.GetHeader("x-real-ip"); v != "" {
+		hops = []string{v}
+	} else if v := r.HeaderValues("forwarded"); len(v) > 0 {
+		hops = forwardedFor(strings.Join(v, ","))
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		ip = hop
+		if !r.Conn.ln.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// forwardedFor returns the 'for' parameters of Forwarded elements, elements
+// without one yield "" so the walk stops there.
+func forwardedFor(v string) (res []string) {
+	for _, elem := range strings.Split(v, ",") {
+		hop := ""
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(k, "for") {
+				hop = strings.Trim(v, `"`)
+			}
+		}
+		res = append(res, hop)
+	}
+	return
+}
+
+// parseHop parses hops like "1.2.3.4", "1.2.3.4:80", "::1" or "[::1]:80",
+// obfuscated identifiers and "unknown" are rejected.
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if a, err := netip.ParseAddr(s); err == nil {
+		return a.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		if a, err := netip.ParseAddr(s[1 : len(s)-1]); err == nil {
+			return a.Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
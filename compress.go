@@ -0,0 +1,179 @@
+package resh
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+)
+
+const (
+	encIdentity = iota
+	encBrotli
+	encGzip
+	encDeflate
+)
+
+var encNames = [...]string{"", "br", "gzip", "deflate"}
+
+var DefaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// Compression enables response compression negotiated from the Accept-Encoding
+// request header. Preference order is br, gzip, deflate.
+type Compression struct {
+	// Responses shorter than MinSize are sent as is. Chunked responses are
+	// always compressed since their size is unknown beforehand.
+	MinSize int
+	// Content type prefixes that can be compressed, nil means DefaultCompressibleTypes.
+	ContentTypes []string
+	// 0 means the default level of each algorithm.
+	GzipLevel   int
+	BrotliLevel int
+	// Disable some algorithms.
+	NoBrotli  bool
+	NoGzip    bool
+	NoDeflate bool
+}
+
+type compressor interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// compressorPools holds compressors of a single loop.
+type compressorPools [len(encNames)]sync.Pool
+
+func (p *compressorPools) get(cfg *Compression, enc uint8, w io.Writer) compressor {
+	if z, _ := p[enc].Get().(compressor); z != nil {
+		z.Reset(w)
+		return z
+	}
+	switch enc {
+	case encBrotli:
+		if cfg.BrotliLevel == 0 {
+			return brotli.NewWriter(w)
+		}
+		return brotli.NewWriterLevel(w, cfg.BrotliLevel)
+	case encGzip:
+		if cfg.GzipLevel == 0 {
+			return gzip.NewWriter(w)
+		}
+		z, _ := gzip.NewWriterLevel(w, cfg.GzipLevel)
+		return z
+	default:
+		if cfg.GzipLevel == 0 {
+			return zlib.NewWriter(w)
+		}
+		z, _ := zlib.NewWriterLevel(w, cfg.GzipLevel)
+		return z
+	}
+}
+
+func (p *compressorPools) put(enc uint8, z compressor) {
+	z.Reset(io.Discard)
+	p[enc].Put(z)
+}
+
+var compressBufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func parseAcceptEncoding(v string) (mask uint8) {
+	for v != "" {
+		var tok string
+		tok, v, _ = strings.Cut(v, ",")
+		name, params, _ := strings.Cut(tok, ";")
+		if _, q, ok := strings.Cut(params, "="); ok {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && f == 0 {
+				continue
+			}
+		}
+		switch name = strings.TrimSpace(name); {
+		case strings.EqualFold(name, "br"):
+			mask |= 1 << encBrotli
+		case strings.EqualFold(name, "gzip"), strings.EqualFold(name, "x-gzip"):
+			mask |= 1 << encGzip
+		case strings.EqualFold(name, "deflate"):
+			mask |= 1 << encDeflate
+		case name == "*":
+			mask |= 1<<encBrotli | 1<<encGzip | 1<<encDeflate
+		}
+	}
+	return
+}
+
+// negotiateEncoding returns the encoding to use for the response, size < 0 means unknown.
+func (r *HTTP) negotiateEncoding(code int, contentType string, hdr http.Header, size int) uint8 {
+	cfg := r.Conn.ln.Compression
+	if cfg == nil || code < 200 || code == 204 || code == 304 && contentType == "" {
+		return encIdentity
+	}
+	if hdr.Get("Content-Encoding") != "" {
+		return encIdentity
+	}
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	types := cfg.ContentTypes
+	if types == nil {
+		types = DefaultCompressibleTypes
+	}
+	ok := false
+	for _, t := range types {
+		if len(contentType) >= len(t) && strings.EqualFold(contentType[:len(t)], t) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return encIdentity
+	}
+	// The response depends on Accept-Encoding even if it is sent as is,
+	// 304 should keep the Vary of 200.
+	r.vary = true
+	if code == 304 || size >= 0 && size < cfg.MinSize {
+		return encIdentity
+	}
+	switch {
+	case r.acceptEnc&(1<<encBrotli) > 0 && !cfg.NoBrotli:
+		return encBrotli
+	case r.acceptEnc&(1<<encGzip) > 0 && !cfg.NoGzip:
+		return encGzip
+	case r.acceptEnc&(1<<encDeflate) > 0 && !cfg.NoDeflate:
+		return encDeflate
+	}
+	return encIdentity
+}
+
+// compress compresses data using the encoding chosen by negotiateEncoding.
+// The returned buffer should be put back to compressBufPool after use.
+func (r *HTTP) compress(data string) *bytes.Buffer {
+	buf := compressBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	pools := &r.Conn.ln.compressors
+	z := pools.get(r.Conn.ln.Compression, r.enc, buf)
+	io.WriteString(z, data)
+	z.Close()
+	pools.put(r.enc, z)
+	return buf
+}
+
+type chunkedSink HTTP
+
+func (w *chunkedSink) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		(*HTTP)(w).writeChunked(p)
+	}
+	return len(p), nil
+}
@@ -1,10 +1,12 @@
 package resh
 
 import (
+	"context"
 	"net"
 	"strconv"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/coyove/resh/internal"
 )
@@ -17,18 +19,30 @@ type Conn struct {
 	ts   int64
 
 	ws  *Websocket
+	h2  *h2Conn
 	fd  int
 	srs serverReadState
 	sa  syscall.Sockaddr
 	ln  *Listener
 	ssl *SSL
 
-	closed atomic.Int32
+	closed    atomic.Int32
+	bodyPause atomic.Int32         // pause state of the streamed request body
+	async     atomic.Pointer[HTTP] // HTTP/1 request being responded, following requests wait for it
+	resume    atomic.Bool          // parse inputs buffered while waiting for async
 
 	// lock protects the following fields
-	lock atomic.Int32
-	in   []byte
-	out  []byte
+	lock    atomic.Int32
+	in      []byte
+	out     []byte
+	closing bool // close the connection once out is fully written
+	drain   chan struct{}
+	onClose []*func()
+	ctx     context.Context // canceled when the connection is closed
+	tasks   []func()        // called in the loop, see runInLoop
+	raw     func([]byte)    // bypass parsing and pass all inputs to raw
+	flushed int64           // total bytes written
+	logs    []*AccessEntry
 }
 
 func (c *Conn) spinLock() {
@@ -67,6 +81,97 @@ func (c *Conn) _writeString(v string) {
 	c.spinUnlock()
 }
 
+func (c *Conn) closeAfterFlush() {
+	c.spinLock()
+	c.closing = true
+	c.spinUnlock()
+}
+
+// Close closes the connection once the pending output is written.
+func (c *Conn) Close() {
+	c.closeAfterFlush()
+	c.Flush()
+}
+
+// OnClose registers f to be called after the connection is closed.
+// If the connection has already been closed, f will be called immediately.
+func (c *Conn) OnClose(f func()) {
+	c.addCloseHook(f)
+}
+
+// addCloseHook registers f like OnClose, the returned function unregisters it.
+func (c *Conn) addCloseHook(f func()) (remove func()) {
+	c.spinLock()
+	if c.closed.Load() == 1 {
+		c.spinUnlock()
+		f()
+		return func() {}
+	}
+	hook := &f
+	c.onClose = append(c.onClose, hook)
+	c.spinUnlock()
+	return func() {
+		c.spinLock()
+		for i, h := range c.onClose {
+			if h == hook {
+				c.onClose = append(c.onClose[:i], c.onClose[i+1:]...)
+				break
+			}
+		}
+		c.spinUnlock()
+	}
+}
+
+// closeContext returns a context canceled after the connection is closed, the
+// contexts of requests derive from it so only one callback is registered.
+func (c *Conn) closeContext() context.Context {
+	var cancel context.CancelFunc
+	c.spinLock()
+	if c.ctx == nil {
+		c.ctx, cancel = context.WithCancel(context.Background())
+	}
+	ctx := c.ctx
+	c.spinUnlock()
+	if cancel != nil {
+		c.OnClose(cancel)
+	}
+	return ctx
+}
+
+// waitDrain blocks until the pending output is shorter than n bytes.
+// It returns false if the connection has been closed.
+func (c *Conn) waitDrain(n int) bool {
+	for c.closed.Load() == 0 {
+		c.spinLock()
+		if len(c.out) < n {
+			c.spinUnlock()
+			return true
+		}
+		if c.drain == nil {
+			c.drain = make(chan struct{}, 1)
+		}
+		ch := c.drain
+		c.spinUnlock()
+
+		c.Flush()
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+		}
+	}
+	return false
+}
+
+// notifyDrain wakes up the waitDrain caller, lock must be held.
+func (c *Conn) notifyDrain() {
+	if c.drain != nil {
+		select {
+		case c.drain <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (c *Conn) Flush() {
 	if c.closed.Load() == 1 {
 		return
@@ -74,6 +179,14 @@ func (c *Conn) Flush() {
 	c.ln.poll.Trigger(c.fd)
 }
 
+// runInLoop calls f in the loop goroutine, f is dropped if the connection is closed.
+func (c *Conn) runInLoop(f func()) {
+	c.spinLock()
+	c.tasks = append(c.tasks, f)
+	c.spinUnlock()
+	c.Flush()
+}
+
 func (c *Conn) truncateInputBuffer(sz int) int {
 	c.spinLock()
 	c.in = c.in[sz:]
@@ -82,6 +195,8 @@ func (c *Conn) truncateInputBuffer(sz int) int {
 	return remain
 }
 
+// ReuseInputBuffer lets the buffer of the released request be reused by
+// following inputs, it must be called in the loop goroutine.
 func (c *Conn) ReuseInputBuffer(in []byte) {
 	c.spinLock()
 	if len(c.in) == 0 {
@@ -0,0 +1,143 @@
+package resh
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cookie represents a Set-Cookie header, see http.Cookie for the meaning of each field.
+type Cookie struct {
+	Name        string
+	Value       string
+	Path        string
+	Domain      string
+	Expires     time.Time
+	MaxAge      int // 0 means no Max-Age, negative means 'Max-Age=0'
+	Secure      bool
+	HttpOnly    bool
+	Partitioned bool
+	SameSite    http.SameSite
+}
+
+// String returns the value of Set-Cookie header, or an empty string if the name is invalid.
+func (c *Cookie) String() string {
+	return string(c.appendTo(nil))
+}
+
+func (c *Cookie) appendTo(b []byte) []byte {
+	if c.Name == "" || strings.IndexFunc(c.Name, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+		return b
+	}
+	b = append(b, c.Name...)
+	b = append(b, '=')
+	b = appendCookieValue(b, c.Value)
+	if c.Path != "" {
+		b = append(b, "; Path="...)
+		b = appendSanitized(b, c.Path, func(c byte) bool { return c >= 0x20 && c < 0x7f && c != ';' })
+	}
+	if c.Domain != "" {
+		b = append(b, "; Domain="...)
+		b = appendSanitized(b, strings.TrimPrefix(c.Domain, "."), func(c byte) bool {
+			return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_'
+		})
+	}
+	if !c.Expires.IsZero() {
+		b = append(b, "; Expires="...)
+		b = c.Expires.UTC().AppendFormat(b, http.TimeFormat)
+	}
+	if c.MaxAge > 0 {
+		b = append(b, "; Max-Age="...)
+		b = strconv.AppendInt(b, int64(c.MaxAge), 10)
+	} else if c.MaxAge < 0 {
+		b = append(b, "; Max-Age=0"...)
+	}
+	if c.HttpOnly {
+		b = append(b, "; HttpOnly"...)
+	}
+	if c.Secure {
+		b = append(b, "; Secure"...)
+	}
+	switch c.SameSite {
+	case http.SameSiteNoneMode:
+		b = append(b, "; SameSite=None"...)
+	case http.SameSiteLaxMode:
+		b = append(b, "; SameSite=Lax"...)
+	case http.SameSiteStrictMode:
+		b = append(b, "; SameSite=Strict"...)
+	}
+	if c.Partitioned {
+		b = append(b, "; Partitioned"...)
+	}
+	return b
+}
+
+func appendCookieValue(b []byte, v string) []byte {
+	valid := func(c byte) bool { return 0x20 <= c && c < 0x7f && c != '"' && c != ';' && c != '\\' }
+	if strings.IndexByte(v, ' ') >= 0 || strings.IndexByte(v, ',') >= 0 {
+		b = append(b, '"')
+		b = appendSanitized(b, v, valid)
+		return append(b, '"')
+	}
+	return appendSanitized(b, v, valid)
+}
+
+func appendSanitized(b []byte, v string, valid func(byte) bool) []byte {
+	for i := 0; i < len(v); i++ {
+		if valid(v[i]) {
+			b = append(b, v[i])
+		}
+	}
+	return b
+}
+
+func isTokenChar(r rune) bool {
+	if r >= 0x7f || r <= 0x20 {
+		return false
+	}
+	return !strings.ContainsRune(`()<>@,;:\"/[]?={}`, r)
+}
+
+// ForeachCookie iterates all cookies sent by the client until f returns false.
+func (r *HTTP) ForeachCookie(f func(name, value string) bool) {
+	r.ForeachHeader(func(k, v string) bool {
+		if k != "cookie" {
+			return true
+		}
+		for v != "" {
+			var part string
+			part, v, _ = strings.Cut(v, ";")
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			if !f(name, value) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Cookie returns the value of the named cookie, or an empty string if not found.
+func (r *HTTP) Cookie(name string) (value string) {
+	r.ForeachCookie(func(k, v string) bool {
+		if k == name {
+			value = v
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// SetCookie adds a Set-Cookie header to the response, it must be called before writing the response.
+func (r *HTTP) SetCookie(c *Cookie) {
+	if v := c.String(); v != "" {
+		r.addHeader("Set-Cookie", v)
+	}
+}
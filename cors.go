@@ -0,0 +1,135 @@
+package resh
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS is a cross-origin resource sharing policy, see CORS.Handler.
+type CORS struct {
+	// AllowOrigins are origins like "https://example.com", patterns with one
+	// '*' like "https://*.example.com", or "*" for any origin.
+	AllowOrigins []string
+	// AllowOriginFunc is consulted if no AllowOrigins matches, optional.
+	AllowOriginFunc func(origin string) bool
+	// AllowMethods are allowed methods, empty means GET, HEAD and POST.
+	AllowMethods []string
+	// AllowHeaders are allowed request headers, "*" allows any.
+	AllowHeaders []string
+	// ExposeHeaders are response headers readable by scripts.
+	ExposeHeaders []string
+	// AllowCredentials can't be used with the "*" origin, echo origins by
+	// AllowOriginFunc instead if that is really intended.
+	AllowCredentials bool
+	// MaxAge is how long preflight results can be cached, 0 means no header.
+	MaxAge time.Duration
+}
+
+func (c *CORS) allowOrigin(origin string) bool {
+	for _, o := range c.AllowOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if pre, suf, ok := strings.Cut(strings.ToLower(o), "*"); ok {
+			lo := strings.ToLower(origin)
+			if len(lo) > len(pre)+len(suf) && strings.HasPrefix(lo, pre) && strings.HasSuffix(lo, suf) {
+				return true
+			}
+		}
+	}
+	return c.AllowOriginFunc != nil && c.AllowOriginFunc(origin)
+}
+
+func (c *CORS) methods() []string {
+	if len(c.AllowMethods) == 0 {
+		return []string{"GET", "HEAD", "POST"}
+	}
+	return c.AllowMethods
+}
+
+func (c *CORS) allowHeaders(req string) bool {
+	for _, h := range strings.Split(req, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		ok := false
+		for _, a := range c.AllowHeaders {
+			if a == "*" || strings.EqualFold(a, h) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// originHeaders adds headers shared by preflights and actual responses.
+func (c *CORS) originHeaders(r *HTTP, origin string) {
+	if c.anyOrigin() {
+		r.addHeader("Access-Control-Allow-Origin", "*")
+		return
+	}
+	r.addHeader("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		r.addHeader("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// anyOrigin reports whether the policy is a plain "*", whose responses don't vary by Origin.
+func (c *CORS) anyOrigin() bool {
+	return len(c.AllowOrigins) == 1 && c.AllowOrigins[0] == "*"
+}
+
+// Handler returns a handler which answers preflight requests and adds CORS
+// headers to responses of next. Wrap authentication inside it, because
+// preflights carry no credentials.
+func (c *CORS) Handler(next func(*HTTP) bool) func(*HTTP) bool {
+	if c.AllowCredentials {
+		for _, o := range c.AllowOrigins {
+			if o == "*" {
+				panic("CORS: AllowCredentials can't be used with the \"*\" origin")
+			}
+		}
+	}
+	return func(r *HTTP) bool {
+		origin := r.GetHeader("origin")
+		reqMethod := r.GetHeader("access-control-request-method")
+		if origin == "" || r.Method() != "OPTIONS" || reqMethod == "" {
+			if !c.anyOrigin() {
+				r.addHeader("Vary", "Origin")
+			}
+			if origin != "" && c.allowOrigin(origin) {
+				c.originHeaders(r, origin)
+				if len(c.ExposeHeaders) > 0 {
+					r.addHeader("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+				}
+			}
+			return next(r)
+		}
+
+		// Preflights never reach next, disallowed ones get no CORS headers.
+		r.addHeader("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+		reqHeaders := strings.Join(r.HeaderValues("access-control-request-headers"), ",")
+		methodOK := false
+		for _, m := range c.methods() {
+			methodOK = methodOK || m == reqMethod
+		}
+		if c.allowOrigin(origin) && methodOK && c.allowHeaders(reqHeaders) {
+			c.originHeaders(r, origin)
+			r.addHeader("Access-Control-Allow-Methods", strings.Join(c.methods(), ", "))
+			if reqHeaders != "" {
+				r.addHeader("Access-Control-Allow-Headers", reqHeaders)
+			}
+			if c.MaxAge > 0 {
+				r.addHeader("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+			}
+		}
+		r.respFull(http.StatusNoContent, "", nil, "").Flush()
+		return true
+	}
+}
@@ -0,0 +1,335 @@
+package resh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	FileIndexNames     = []string{"index.html"}
+	FileMaxRanges      = 16
+	fileCopyBufferPool = sync.Pool{New: func() any { return make([]byte, 64*1024) }}
+)
+
+// FileServer returns an OnHTTP handler serving files under root, r.Path is
+// used as the file path so callers can strip their prefixes beforehand.
+// Files are read in a separate goroutine and written at the pace of the client.
+func FileServer(root string) func(*HTTP) bool {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		panic(err)
+	}
+	if r, err := filepath.EvalSymlinks(root); err == nil {
+		root = r
+	}
+	return func(r *HTTP) bool {
+		go serveFile(r, root)
+		return true
+	}
+}
+
+func serveFile(r *HTTP, root string) {
+	switch r.Method() {
+	case "GET", "HEAD":
+	default:
+		r.BytesHeaders(405, "", http.Header{"Allow": {"GET, HEAD"}}, []byte(http.StatusText(405))).Flush()
+		return
+	}
+
+	upath := r.Path
+	if strings.IndexByte(upath, 0) >= 0 || strings.IndexByte(upath, '\\') >= 0 {
+		r.Text(400, http.StatusText(400)).Flush()
+		return
+	}
+	name := filepath.Join(root, filepath.FromSlash(path.Clean("/"+upath)))
+	if real, err := filepath.EvalSymlinks(name); err == nil && real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+		r.Text(404, http.StatusText(404)).Flush()
+		return
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		r.fileError(err)
+		return
+	}
+	defer func() { f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		r.fileError(err)
+		return
+	}
+
+	if fi.IsDir() {
+		if !strings.HasSuffix(upath, "/") {
+			// Relative, so it works when mounted under a stripped prefix.
+			r.Redirect(301, (&url.URL{Path: path.Base(upath) + "/", RawQuery: strings.Clone(r.RawQuery())}).String()).Flush()
+			return
+		}
+		found := false
+		for _, index := range FileIndexNames {
+			ff, err := os.Open(filepath.Join(name, index))
+			if err != nil {
+				continue
+			}
+			if ffi, err := ff.Stat(); err == nil && !ffi.IsDir() {
+				f.Close()
+				f, fi, name, found = ff, ffi, filepath.Join(name, index), true
+				break
+			}
+			ff.Close()
+		}
+		if !found {
+			r.serveDir(f)
+			return
+		}
+	}
+
+	r.serveContent(name, f, fi.Size(), fi.ModTime())
+}
+
+func (r *HTTP) fileError(err error) {
+	switch {
+	case os.IsNotExist(err):
+		r.Text(404, http.StatusText(404))
+	case os.IsPermission(err):
+		r.Text(403, http.StatusText(403))
+	default:
+		r.Text(500, http.StatusText(500))
+	}
+	r.Flush()
+}
+
+func (r *HTTP) serveDir(f *os.File) {
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		r.fileError(err)
+		return
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("<!doctype html>\n<pre>\n")
+	for _, name := range names {
+		if fi, err := os.Stat(filepath.Join(f.Name(), name)); err == nil && fi.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", (&url.URL{Path: name}).EscapedPath(), html.EscapeString(name))
+	}
+	b.WriteString("</pre>\n")
+	r.Bytes(200, "text/html; charset=utf-8", []byte(b.String())).Flush()
+}
+
+type httpRange struct {
+	start, length int64
+}
+
+func (rg httpRange) contentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(rg.start, 10) + "-" + strconv.FormatInt(rg.start+rg.length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+// parseRange parses a 'bytes=' Range header, nil means the whole content.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, fmt.Errorf("invalid range")
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range")
+		}
+		start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+		var r httpRange
+		if start == "" {
+			// -N means the last N bytes.
+			i, err := strconv.ParseInt(end, 10, 64)
+			if end == "" || err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid range")
+			}
+			if i > size {
+				i = size
+			}
+			r.start, r.length = size-i, i
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid range")
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, fmt.Errorf("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, fmt.Errorf("invalid range: failed to overlap")
+	}
+	return ranges, nil
+}
+
+func etagMatch(list, etag string, weak bool) bool {
+	for list != "" {
+		var tag string
+		tag, list, _ = strings.Cut(list, ",")
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *HTTP) notModified(etag string, modtime time.Time) bool {
+	if inm := r.GetHeader("if-none-match"); inm != "" {
+		return etagMatch(inm, etag, true)
+	}
+	if ims := r.GetHeader("if-modified-since"); ims != "" && !modtime.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modtime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+func (r *HTTP) serveContent(name string, f *os.File, size int64, modtime time.Time) {
+	etag := "\"" + strconv.FormatInt(modtime.UnixNano(), 16) + "-" + strconv.FormatInt(size, 16) + "\""
+	hdr := http.Header{
+		"ETag":          {etag},
+		"Last-Modified": {modtime.UTC().Format(http.TimeFormat)},
+		"Accept-Ranges": {"bytes"},
+	}
+
+	if r.notModified(etag, modtime) {
+		r.BytesHeaders(304, "", hdr, nil).Flush()
+		return
+	}
+
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if ctype == "" {
+		var buf [512]byte
+		n, _ := io.ReadFull(f, buf[:])
+		ctype = http.DetectContentType(buf[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			r.fileError(err)
+			return
+		}
+	}
+
+	var ranges []httpRange
+	rh := r.GetHeader("range")
+	if ir := r.GetHeader("if-range"); rh != "" && ir != "" && ir != etag {
+		if t, err := http.ParseTime(ir); err != nil || !modtime.Truncate(time.Second).Equal(t) {
+			rh = ""
+		}
+	}
+	if rh != "" {
+		var err error
+		if ranges, err = parseRange(rh, size); err != nil {
+			hdr.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+			r.BytesHeaders(416, "", hdr, []byte(err.Error())).Flush()
+			return
+		}
+	}
+
+	head := r.Method() == "HEAD"
+	switch {
+	case len(ranges) == 0 || len(ranges) > FileMaxRanges:
+		r.respHeaders(200, ctype, hdr, size)
+		if !head && !r.copyFile(f, httpRange{0, size}) {
+			return
+		}
+	case len(ranges) == 1:
+		hdr.Set("Content-Range", ranges[0].contentRange(size))
+		r.respHeaders(206, ctype, hdr, ranges[0].length)
+		if !head && !r.copyFile(f, ranges[0]) {
+			return
+		}
+	default:
+		var rnd [12]byte
+		rand.Read(rnd[:])
+		boundary := hex.EncodeToString(rnd[:])
+		parts := make([]string, len(ranges))
+		total := int64(len("\r\n--" + boundary + "--\r\n"))
+		for i, ra := range ranges {
+			parts[i] = "\r\n--" + boundary + "\r\nContent-Type: " + ctype + "\r\nContent-Range: " + ra.contentRange(size) + "\r\n\r\n"
+			total += int64(len(parts[i])) + ra.length
+		}
+		r.respHeaders(206, "multipart/byteranges; boundary="+boundary, hdr, total)
+		if !head {
+			for i, ra := range ranges {
+				r.writeBody(parts[i])
+				if !r.copyFile(f, ra) {
+					return
+				}
+			}
+			r.writeBody("\r\n--" + boundary + "--\r\n")
+		}
+	}
+	r.done()
+	r.Flush()
+}
+
+// copyFile copies a section of f to the output, it waits for the output to
+// drain before reading more.
+func (r *HTTP) copyFile(f *os.File, ra httpRange) bool {
+	buf := fileCopyBufferPool.Get().([]byte)
+	defer fileCopyBufferPool.Put(buf)
+
+	for off, end := ra.start, ra.start+ra.length; off < end; {
+		p := buf
+		if int64(len(p)) > end-off {
+			p = p[:end-off]
+		}
+		n, err := f.ReadAt(p, off)
+		if n == 0 && err != nil {
+			// Headers have been sent, nothing can be done but truncating.
+			r.Abort()
+			return false
+		}
+		off += int64(n)
+		r.writeBody(btos(p[:n]))
+		if !r.waitDrain() {
+			return false
+		}
+	}
+	return true
+}
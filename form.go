@@ -0,0 +1,152 @@
+package resh
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+var (
+	MultipartMaxParts     = 1000
+	MultipartMaxPartBytes = 1 * 1024 * 1024
+)
+
+func (r *HTTP) contentTypeIs(mediaType string) bool {
+	ct := r.GetHeader("content-type")
+	if len(ct) < len(mediaType) || !strings.EqualFold(ct[:len(mediaType)], mediaType) {
+		return false
+	}
+	return len(ct) == len(mediaType) || ct[len(mediaType)] == ';' || ct[len(mediaType)] == ' '
+}
+
+// ForeachForm iterates fields of an 'application/x-www-form-urlencoded' body.
+// The body is unescaped in place on the first call.
+func (r *HTTP) ForeachForm(f func(k string, v string)) {
+	if r.form == nil {
+		r.form = [][2]string{}
+		if r.contentTypeIs("application/x-www-form-urlencoded") {
+			for body := r.Body(); len(body) > 0; {
+				var part []byte
+				part, body, _ = bytes.Cut(body, []byte("&"))
+				if len(part) == 0 {
+					continue
+				}
+				key, value, _ := bytes.Cut(part, []byte("="))
+				r.form = append(r.form, [2]string{btos(UnescapeInplace(key, true)), btos(UnescapeInplace(value, true))})
+			}
+		}
+	}
+	for _, kv := range r.form {
+		f(kv[0], kv[1])
+	}
+}
+
+// FormValue returns the first value of the key in the urlencoded body, or in the query if not found.
+func (r *HTTP) FormValue(k string) (value string) {
+	found := false
+	r.ForeachForm(func(fk, fv string) {
+		if !found && fk == k {
+			value, found = fv, true
+		}
+	})
+	if !found {
+		value = r.GetQuery(k)
+	}
+	return
+}
+
+// Part is a part of a 'multipart/form-data' body, all fields reference the
+// request body directly and are only valid before Release.
+type Part struct {
+	Name        string
+	FileName    string
+	ContentType string
+	Header      []byte // raw header lines, keys are lowercased
+	Data        []byte
+}
+
+// GetHeader returns the value of the part header, key is case-insensitive.
+func (p *Part) GetHeader(key string) string {
+	for hdr := p.Header; len(hdr) > 0; {
+		var line []byte
+		line, hdr, _ = bytes.Cut(hdr, crlf)
+		if k, v, ok := bytes.Cut(line, []byte(":")); ok && strings.EqualFold(btos(k), key) {
+			return btos(bytes.TrimSpace(v))
+		}
+	}
+	return ""
+}
+
+// ForeachPart iterates parts of a 'multipart/form-data' body until f returns false.
+// The number of parts and the size of each part are limited by MultipartMaxParts
+// and MultipartMaxPartBytes.
+func (r *HTTP) ForeachPart(f func(*Part) bool) error {
+	mt, params, err := mime.ParseMediaType(r.GetHeader("content-type"))
+	if err != nil {
+		return fmt.Errorf("multipart: %v", err)
+	}
+	if !strings.HasPrefix(mt, "multipart/") || params["boundary"] == "" {
+		return fmt.Errorf("multipart: not a multipart request")
+	}
+	delim := []byte("\r\n--" + params["boundary"])
+
+	// The first delimiter may appear without the leading CRLF.
+	body := r.Body()
+	if bytes.HasPrefix(body, delim[2:]) {
+		body = body[len(delim)-2:]
+	} else if idx := bytes.Index(body, delim); idx >= 0 {
+		body = body[idx+len(delim):]
+	} else {
+		return fmt.Errorf("multipart: missing first boundary")
+	}
+
+	for n := 0; ; n++ {
+		if bytes.HasPrefix(body, []byte("--")) {
+			return nil
+		}
+		if !bytes.HasPrefix(body, crlf) {
+			return fmt.Errorf("multipart: invalid boundary")
+		}
+		if n >= MultipartMaxParts {
+			return fmt.Errorf("multipart: too many parts")
+		}
+		body = body[2:]
+
+		idx := bytes.Index(body, delim)
+		if idx == -1 {
+			return fmt.Errorf("multipart: unexpected EOF")
+		}
+		raw := body[:idx]
+		body = body[idx+len(delim):]
+
+		var p Part
+		if bytes.HasPrefix(raw, crlf) {
+			p.Data = raw[2:]
+		} else if hdrEnd := bytes.Index(raw, []byte("\r\n\r\n")); hdrEnd >= 0 {
+			p.Header, p.Data = raw[:hdrEnd], raw[hdrEnd+4:]
+		} else {
+			return fmt.Errorf("multipart: invalid part header")
+		}
+		if len(p.Data) > MultipartMaxPartBytes {
+			return fmt.Errorf("multipart: part too large: %db", len(p.Data))
+		}
+		for _, line := range bytes.Split(p.Header, crlf) {
+			for i, c := range line {
+				if c == ':' {
+					break
+				}
+				if 'A' <= c && c <= 'Z' {
+					line[i] = c - 'A' + 'a'
+				}
+			}
+		}
+		if _, params, err := mime.ParseMediaType(p.GetHeader("content-disposition")); err == nil {
+			p.Name, p.FileName = params["name"], params["filename"]
+		}
+		p.ContentType = p.GetHeader("content-type")
+		if !f(&p) {
+			return nil
+		}
+	}
+}
@@ -3,24 +3,25 @@ module github.com/coyove/resh
 go 1.20
 
 require (
+	github.com/andybalholm/brotli v1.0.5
 	github.com/coyove/sdss v0.0.0-20231129015646-c2ec58cca6a2
 	github.com/evanphx/wildcat v0.0.0-20141114174135-e7012f664567
 	github.com/gorilla/websocket v1.5.1
 	github.com/kavu/go_reuseport v1.5.0
+	github.com/klauspost/compress v1.17.0
 	github.com/panjf2000/gnet/v2 v2.3.3
 	github.com/valyala/fasthttp v1.51.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.5 // indirect
-	github.com/klauspost/compress v1.17.0 // indirect
 	github.com/sirupsen/logrus v1.9.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/vektra/errors v0.0.0-20140903201135-c64d83aba85a // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.21.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sync v0.3.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
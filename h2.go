@@ -0,0 +1,814 @@
+package resh
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	h2Data         = 0x0
+	h2Headers      = 0x1
+	h2Priority     = 0x2
+	h2RstStream    = 0x3
+	h2Settings     = 0x4
+	h2PushPromise  = 0x5
+	h2Ping         = 0x6
+	h2GoAway       = 0x7
+	h2WindowUpdate = 0x8
+	h2Continuation = 0x9
+
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	h2ErrNo              = 0x0
+	h2ErrProtocol        = 0x1
+	h2ErrInternal        = 0x2
+	h2ErrFlowControl     = 0x3
+	h2ErrStreamClosed    = 0x5
+	h2ErrFrameSize       = 0x6
+	h2ErrRefusedStream   = 0x7
+	h2ErrCancel          = 0x8
+	h2ErrCompression     = 0x9
+	h2ErrEnhanceYourCalm = 0xb
+
+	h2MaxFrameSize  = 16384 // the default SETTINGS_MAX_FRAME_SIZE, which we never raise
+	h2DefaultWindow = 65535
+	h2MaxWindow     = 1<<31 - 1
+)
+
+var errH2Preface = fmt.Errorf("http2 preface")
+
+// h2Error is a connection error, GOAWAY will be sent and the connection closed.
+type h2Error struct {
+	code  uint32
+	cause error
+}
+
+func (e *h2Error) Error() string {
+	return fmt.Sprintf("http2 error %d: %v", e.code, e.cause)
+}
+
+func h2Errorf(code uint32, format string, args ...any) *h2Error {
+	return &h2Error{code, fmt.Errorf(format, args...)}
+}
+
+// h2Conn is the HTTP/2 state of a connection. Frames are parsed by the loop,
+// responses are written by handlers from any goroutine.
+type h2Conn struct {
+	c        *Conn
+	dec      *hpack.Decoder
+	prefaced bool
+	lastID   uint32 // the last stream opened by the client
+	hdrID    uint32 // the stream whose header block is being continued
+	hdrFlags uint8
+	hdrBlock []byte
+	goaway   bool
+
+	// mu protects the following fields, HEADERS must be encoded and written in order.
+	mu         sync.Mutex
+	enc        *hpack.Encoder
+	encBuf     bytes.Buffer
+	streams    map[uint32]*h2Stream
+	window     int64 // connection send window
+	initWindow int64 // peer SETTINGS_INITIAL_WINDOW_SIZE
+	maxFrame   int   // peer SETTINGS_MAX_FRAME_SIZE
+}
+
+type h2Stream struct {
+	id      uint32
+	h       *h2Conn
+	req     *HTTP
+	body    []byte
+	ready   bool        // request has been fully received
+	bs      *BodyStream // the body is streamed
+	maxBody int         // size limit of the buffered body
+
+	// response headers being built
+	status int
+	hdrs   [][2]string
+	log    *AccessEntry
+	sent   int // response bytes
+
+	// protected by h.mu
+	window   int64
+	pending  []byte      // data blocked by flow control
+	fin      bool        // END_STREAM follows pending
+	trailers [][2]string // sent as HEADERS with END_STREAM after pending
+	ended    bool        // END_STREAM has been sent
+	reset    bool
+
+	bodyPause int // pause state of the streamed body
+	unacked   int // received body not yet restored to the window while paused
+}
+
+func newH2Conn(c *Conn) *h2Conn {
+	h := &h2Conn{
+		c:          c,
+		streams:    map[uint32]*h2Stream{},
+		window:     h2DefaultWindow,
+		initWindow: h2DefaultWindow,
+		maxFrame:   h2MaxFrameSize,
+	}
+	h.dec = hpack.NewDecoder(4096, nil)
+	h.dec.SetMaxStringLength(c.ln.HTTPMaxHeaderBytes)
+	h.enc = hpack.NewEncoder(&h.encBuf)
+
+	var p []byte
+	p = binary.BigEndian.AppendUint16(p, 0x3) // SETTINGS_MAX_CONCURRENT_STREAMS
+	p = binary.BigEndian.AppendUint32(p, uint32(c.ln.HTTP2MaxStreams))
+	p = binary.BigEndian.AppendUint16(p, 0x6) // SETTINGS_MAX_HEADER_LIST_SIZE
+	p = binary.BigEndian.AppendUint32(p, uint32(c.ln.HTTPMaxHeaderBytes))
+	h.writeFrame(h2Settings, 0, 0, p)
+	return h
+}
+
+func h2AppendFrame(dst []byte, typ, flags uint8, id uint32, p []byte) []byte {
+	n := len(p)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), typ, flags)
+	dst = binary.BigEndian.AppendUint32(dst, id)
+	return append(dst, p...)
+}
+
+func (h *h2Conn) writeFrame(typ, flags uint8, id uint32, p []byte) {
+	h.c.spinLock()
+	h.c.out = h2AppendFrame(h.c.out, typ, flags, id, p)
+	h.c.spinUnlock()
+}
+
+func (h *h2Conn) stream(id uint32) *h2Stream {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.streams[id]
+}
+
+// process parses and handles all complete frames in the input, returning the number of bytes consumed.
+func (h *h2Conn) process(in []byte) (int, error) {
+	n := 0
+	if !h.prefaced {
+		if len(in) < len(h2Preface) {
+			if string(in) != h2Preface[:len(in)] {
+				return 0, h2Errorf(h2ErrProtocol, "invalid preface")
+			}
+			return 0, nil
+		}
+		if string(in[:len(h2Preface)]) != h2Preface {
+			return 0, h2Errorf(h2ErrProtocol, "invalid preface")
+		}
+		n, h.prefaced = len(h2Preface), true
+	}
+	for len(in)-n >= 9 {
+		length := int(in[n])<<16 | int(in[n+1])<<8 | int(in[n+2])
+		if length > h2MaxFrameSize {
+			return n, h2Errorf(h2ErrFrameSize, "frame too large: %db", length)
+		}
+		if len(in)-n < 9+length {
+			break
+		}
+		typ, flags, id := in[n+3], in[n+4], binary.BigEndian.Uint32(in[n+5:])&h2MaxWindow
+		p := in[n+9 : n+9+length]
+		n += 9 + length
+		if err := h.frame(typ, flags, id, p); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func h2Unpad(flags uint8, p []byte) ([]byte, error) {
+	if flags&h2FlagPadded == 0 {
+		return p, nil
+	}
+	if len(p) == 0 || int(p[0]) >= len(p) {
+		return nil, h2Errorf(h2ErrProtocol, "invalid padding")
+	}
+	return p[1 : len(p)-int(p[0])], nil
+}
+
+func (h *h2Conn) frame(typ, flags uint8, id uint32, p []byte) error {
+	if h.hdrID != 0 && (typ != h2Continuation || id != h.hdrID) {
+		return h2Errorf(h2ErrProtocol, "expect CONTINUATION of stream %d", h.hdrID)
+	}
+	switch typ {
+	case h2Data:
+		if id == 0 {
+			return h2Errorf(h2ErrProtocol, "DATA on stream 0")
+		}
+		size := len(p)
+		p, err := h2Unpad(flags, p)
+		if err != nil {
+			return err
+		}
+		if size > 0 {
+			h.windowUpdate(0, size)
+		}
+		s := h.stream(id)
+		if s == nil || s.ready {
+			if id > h.lastID {
+				return h2Errorf(h2ErrProtocol, "DATA on idle stream %d", id)
+			}
+			h.rst(id, h2ErrStreamClosed)
+			return nil
+		}
+		if s.bs != nil {
+			return h.bodyData(s, p, size, flags&h2FlagEndStream != 0)
+		}
+		if s.body = append(s.body, p...); len(s.body) > s.maxBody {
+			h.reject(s, &httpError{413, fmt.Errorf("request body too large: %db", len(s.body))}, flags&h2FlagEndStream != 0)
+			return nil
+		}
+		if flags&h2FlagEndStream != 0 {
+			return h.dispatch(s)
+		}
+		if size > 0 {
+			h.windowUpdate(id, size)
+		}
+	case h2Headers:
+		if id == 0 || id%2 == 0 {
+			return h2Errorf(h2ErrProtocol, "HEADERS on invalid stream %d", id)
+		}
+		p, err := h2Unpad(flags, p)
+		if err != nil {
+			return err
+		}
+		if flags&h2FlagPriority != 0 {
+			if len(p) < 5 {
+				return h2Errorf(h2ErrFrameSize, "invalid HEADERS priority")
+			}
+			p = p[5:]
+		}
+		h.hdrID, h.hdrFlags, h.hdrBlock = id, flags, append(h.hdrBlock[:0], p...)
+		if flags&h2FlagEndHeaders != 0 {
+			return h.endHeaders()
+		}
+	case h2Continuation:
+		if h.hdrID == 0 {
+			return h2Errorf(h2ErrProtocol, "unexpected CONTINUATION")
+		}
+		if h.hdrBlock = append(h.hdrBlock, p...); len(h.hdrBlock) > h.c.ln.HTTPMaxHeaderBytes {
+			return h2Errorf(h2ErrEnhanceYourCalm, "header block too large")
+		}
+		if flags&h2FlagEndHeaders != 0 {
+			return h.endHeaders()
+		}
+	case h2Priority:
+		if id == 0 {
+			return h2Errorf(h2ErrProtocol, "PRIORITY on stream 0")
+		}
+	case h2RstStream:
+		if len(p) != 4 {
+			return h2Errorf(h2ErrFrameSize, "invalid RST_STREAM")
+		}
+		if id == 0 || id > h.lastID {
+			return h2Errorf(h2ErrProtocol, "RST_STREAM on idle stream %d", id)
+		}
+		h.mu.Lock()
+		s := h.streams[id]
+		if s != nil {
+			s.reset = true
+			delete(h.streams, id)
+		}
+		h.mu.Unlock()
+		h.c.spinLock()
+		if s != nil {
+			s.endLog()
+		}
+		h.c.notifyDrain()
+		h.c.spinUnlock()
+		if s != nil && s.bs != nil && !s.ready {
+			s.ready = true
+			s.bs.end(errBodyAborted)
+		}
+	case h2Settings:
+		if id != 0 {
+			return h2Errorf(h2ErrProtocol, "SETTINGS on stream %d", id)
+		}
+		if flags&h2FlagAck != 0 {
+			if len(p) != 0 {
+				return h2Errorf(h2ErrFrameSize, "invalid SETTINGS ack")
+			}
+			return nil
+		}
+		if len(p)%6 != 0 {
+			return h2Errorf(h2ErrFrameSize, "invalid SETTINGS")
+		}
+		if err := h.applySettings(p); err != nil {
+			return err
+		}
+		h.writeFrame(h2Settings, h2FlagAck, 0, nil)
+	case h2PushPromise:
+		return h2Errorf(h2ErrProtocol, "PUSH_PROMISE from client")
+	case h2Ping:
+		if id != 0 {
+			return h2Errorf(h2ErrProtocol, "PING on stream %d", id)
+		}
+		if len(p) != 8 {
+			return h2Errorf(h2ErrFrameSize, "invalid PING")
+		}
+		if flags&h2FlagAck == 0 {
+			h.writeFrame(h2Ping, h2FlagAck, 0, p)
+		}
+	case h2GoAway:
+		if id != 0 {
+			return h2Errorf(h2ErrProtocol, "GOAWAY on stream %d", id)
+		}
+		h.goaway = true
+	case h2WindowUpdate:
+		if len(p) != 4 {
+			return h2Errorf(h2ErrFrameSize, "invalid WINDOW_UPDATE")
+		}
+		return h.incWindow(id, int64(binary.BigEndian.Uint32(p)&h2MaxWindow))
+	}
+	return nil
+}
+
+func (h *h2Conn) incWindow(id uint32, inc int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if id == 0 {
+		if inc == 0 {
+			return h2Errorf(h2ErrProtocol, "zero WINDOW_UPDATE")
+		}
+		if h.window += inc; h.window > h2MaxWindow {
+			return h2Errorf(h2ErrFlowControl, "connection window overflow")
+		}
+		for _, s := range h.streams {
+			if len(s.pending) > 0 {
+				h.flush(s)
+			}
+		}
+		return nil
+	}
+	s := h.streams[id]
+	if s == nil {
+		return nil
+	}
+	if s.window += inc; inc == 0 || s.window > h2MaxWindow {
+		s.reset = true
+		delete(h.streams, id)
+		h.writeFrame(h2RstStream, 0, id, binary.BigEndian.AppendUint32(nil, h2ErrFlowControl))
+		return nil
+	}
+	h.flush(s)
+	return nil
+}
+
+func (h *h2Conn) applySettings(p []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ; len(p) >= 6; p = p[6:] {
+		v := binary.BigEndian.Uint32(p[2:])
+		switch binary.BigEndian.Uint16(p) {
+		case 0x1: // SETTINGS_HEADER_TABLE_SIZE
+			h.enc.SetMaxDynamicTableSizeLimit(v)
+		case 0x2: // SETTINGS_ENABLE_PUSH
+			if v > 1 {
+				return h2Errorf(h2ErrProtocol, "invalid SETTINGS_ENABLE_PUSH %d", v)
+			}
+		case 0x4: // SETTINGS_INITIAL_WINDOW_SIZE
+			if v > h2MaxWindow {
+				return h2Errorf(h2ErrFlowControl, "invalid SETTINGS_INITIAL_WINDOW_SIZE %d", v)
+			}
+			delta := int64(v) - h.initWindow
+			h.initWindow = int64(v)
+			for _, s := range h.streams {
+				if s.window += delta; s.window > h2MaxWindow {
+					return h2Errorf(h2ErrFlowControl, "stream window overflow")
+				}
+				if delta > 0 && len(s.pending) > 0 {
+					h.flush(s)
+				}
+			}
+		case 0x5: // SETTINGS_MAX_FRAME_SIZE
+			if v < h2MaxFrameSize || v > 1<<24-1 {
+				return h2Errorf(h2ErrProtocol, "invalid SETTINGS_MAX_FRAME_SIZE %d", v)
+			}
+			h.maxFrame = int(v)
+		}
+	}
+	return nil
+}
+
+func (h *h2Conn) windowUpdate(id uint32, n int) {
+	h.writeFrame(h2WindowUpdate, 0, id, binary.BigEndian.AppendUint32(nil, uint32(n)))
+}
+
+// rst resets the stream with the error code.
+func (h *h2Conn) rst(id uint32, code uint32) {
+	h.mu.Lock()
+	if s := h.streams[id]; s != nil {
+		s.reset = true
+		delete(h.streams, id)
+	}
+	h.mu.Unlock()
+	h.writeFrame(h2RstStream, 0, id, binary.BigEndian.AppendUint32(nil, code))
+}
+
+// goAway sends GOAWAY and closes the connection once the output is flushed.
+func (h *h2Conn) goAway(e *h2Error) {
+	if e.cause != nil {
+		h.c.ln.OnError(Error{Type: "http2", Cause: e})
+	}
+	p := binary.BigEndian.AppendUint32(nil, h.lastID)
+	h.writeFrame(h2GoAway, 0, 0, binary.BigEndian.AppendUint32(p, e.code))
+	h.c.closeAfterFlush()
+}
+
+func (h *h2Conn) endHeaders() error {
+	id, flags := h.hdrID, h.hdrFlags
+	h.hdrID = 0
+	fields, err := h.dec.DecodeFull(h.hdrBlock)
+	if err != nil {
+		return &h2Error{h2ErrCompression, err}
+	}
+
+	if id <= h.lastID {
+		// Trailers, which are not exposed.
+		s := h.stream(id)
+		if s == nil || s.ready {
+			h.rst(id, h2ErrStreamClosed)
+			return nil
+		}
+		if flags&h2FlagEndStream == 0 {
+			return h2Errorf(h2ErrProtocol, "trailers without END_STREAM")
+		}
+		if s.bs != nil {
+			s.ready = true
+			s.bs.end(nil)
+			return nil
+		}
+		return h.dispatch(s)
+	}
+
+	h.lastID = id
+	h.mu.Lock()
+	refused := h.goaway || len(h.streams) >= h.c.ln.HTTP2MaxStreams
+	s := &h2Stream{id: id, h: h, window: h.initWindow}
+	if !refused {
+		h.streams[id] = s
+	}
+	h.mu.Unlock()
+	if refused {
+		h.rst(id, h2ErrRefusedStream)
+		return nil
+	}
+
+	endStream := flags&h2FlagEndStream != 0
+	if s.req, err = h.request(fields); err != nil {
+		if e, ok := err.(*httpError); ok {
+			h.reject(s, e, endStream)
+		} else {
+			h.c.ln.OnError(Error{Type: "http2", Cause: err})
+			h.rst(id, h2ErrProtocol)
+		}
+		return nil
+	}
+	if endStream {
+		return h.dispatch(s)
+	}
+	s.maxBody = h.c.ln.maxBodyBytes(s.req)
+	if ln := h.c.ln; ln.OnHTTPBody != nil {
+		s.req.Conn, s.req.h2 = h.c, s
+		if s.bs = ln.OnHTTPBody(s.req); s.bs != nil {
+			if n, err := strconv.Atoi(s.req.GetHeader("content-length")); err == nil && n > s.bs.maxBytes() {
+				e := &httpError{413, fmt.Errorf("request body too large: %db > %db", n, s.bs.maxBytes())}
+				s.bs = nil
+				h.reject(s, e, false)
+				return nil
+			}
+			return h.dispatch(s)
+		}
+	}
+	return nil
+}
+
+// request converts decoded fields into an HTTP/1 style header block, so
+// HTTP/2 requests share the parsing and accessors of HTTP/1.
+func (h *h2Conn) request(fields []hpack.HeaderField) (*HTTP, error) {
+	var method, path, authority string
+	var hdrs []byte
+	size, regular := 0, false
+	for _, f := range fields {
+		size += len(f.Name) + len(f.Value) + 32
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, fmt.Errorf("pseudo header %q after regular headers", f.Name)
+			}
+			switch f.Name {
+			case ":method":
+				method = f.Value
+			case ":path":
+				path = f.Value
+			case ":authority":
+				authority = f.Value
+			case ":scheme":
+			default:
+				return nil, fmt.Errorf("invalid pseudo header %q", f.Name)
+			}
+			continue
+		}
+		regular = true
+		if !validHeaderName(f.Name) || strings.ToLower(f.Name) != f.Name || !validHeaderValue(f.Value) {
+			return nil, fmt.Errorf("invalid header %q: %q", f.Name, f.Value)
+		}
+		switch f.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return nil, fmt.Errorf("connection-specific header %q", f.Name)
+		case "te":
+			if f.Value != "trailers" {
+				return nil, fmt.Errorf("invalid TE %q", f.Value)
+			}
+		}
+		hdrs = append(append(append(append(hdrs, f.Name...), ": "...), f.Value...), "\r\n"...)
+	}
+	if size > h.c.ln.HTTPMaxHeaderBytes {
+		return nil, &httpError{431, fmt.Errorf("request header too large")}
+	}
+	if method == "" || path == "" || !validHeaderName(method) || strings.ContainsAny(path, " \t\r\n") {
+		return nil, fmt.Errorf("invalid request %q %q", method, path)
+	}
+
+	buf := make([]byte, 0, len(method)+len(path)+len(hdrs)+len(authority)+32)
+	buf = append(append(append(append(buf, method...), ' '), path...), " HTTP/1.1\r\n"...)
+	buf = append(buf, hdrs...)
+	if authority != "" {
+		buf = append(append(append(buf, "host: "...), authority...), "\r\n"...)
+	}
+	r := &HTTP{data: append(buf, "\r\n"...)}
+	if err := r.parse(h.c.ln, false); err != nil {
+		return nil, err
+	}
+	r.bodyLen, r.expect100 = 0, false
+	return r, nil
+}
+
+// dispatch calls OnHTTP once the request is received, or its headers are
+// received if the body is streamed.
+func (h *h2Conn) dispatch(s *h2Stream) error {
+	r := s.req
+	if s.bs == nil {
+		s.ready = true
+		r.data = append(r.data, s.body...)
+		r.bodyLen = uint32(len(s.body))
+		s.body = nil
+	}
+	r.Conn, r.h2 = h.c, s
+	h.c.ln.logHTTP(r)
+	if !h.c.ln.OnHTTP(r) {
+		return &h2Error{code: h2ErrNo}
+	}
+	return nil
+}
+
+// reject responds with the error and resets the stream if the request is not fully received.
+func (h *h2Conn) reject(s *h2Stream, e *httpError, endStream bool) {
+	ln := h.c.ln
+	ln.OnError(Error{Type: "http2", Cause: e})
+	contentType, body := "", []byte(http.StatusText(e.code))
+	if ln.OnHTTPError != nil {
+		contentType, body = ln.OnHTTPError(e.code, e.cause)
+	}
+	s.ready = true
+	(&HTTP{Conn: h.c, h2: s}).Bytes(e.code, contentType, body)
+	if !endStream {
+		h.rst(s.id, h2ErrNo)
+	}
+}
+
+// upgradeH2C switches the connection to HTTP/2 after an 'Upgrade: h2c' request,
+// which becomes stream 1. It returns false if the upgrade can't be done.
+func (ln *Listener) upgradeH2C(c *Conn, r *HTTP) bool {
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.GetHeader("http2-settings"), "="))
+	if err != nil || len(settings)%6 != 0 {
+		return false
+	}
+	c._writeString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	h := newH2Conn(c)
+	s := &h2Stream{id: 1, h: h, req: r, ready: true}
+	if err := h.applySettings(settings); err != nil {
+		s.reset = true
+		h.goAway(err.(*h2Error))
+	}
+	s.window = h.initWindow
+	h.lastID = 1
+	h.streams[1] = s
+	c.h2 = h
+	r.h2, r.closeConn, r.expect100 = s, false, false
+	return true
+}
+
+func (ln *Listener) readH2(c *Conn, in []byte) {
+	n, err := c.h2.process(in)
+	c.truncateInputBuffer(n)
+	if err != nil {
+		c.h2.goAway(err.(*h2Error))
+	}
+	if len(c.out) != 0 {
+		ln.writeConn(c)
+	}
+}
+
+func (s *h2Stream) begin(code int) {
+	s.status = code
+	s.hdrs = s.hdrs[:0]
+}
+
+func (s *h2Stream) header(k, v string) {
+	switch k = strings.ToLower(k); k {
+	case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+	default:
+		s.hdrs = append(s.hdrs, [2]string{k, v})
+	}
+}
+
+// writeHeaders sends the response headers, endStream means there is no body.
+func (s *h2Stream) writeHeaders(endStream bool) {
+	h := s.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s.reset || s.ended {
+		return
+	}
+	h.encBuf.Reset()
+	h.enc.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(s.status)})
+	for _, kv := range s.hdrs {
+		h.enc.WriteField(hpack.HeaderField{Name: kv[0], Value: kv[1]})
+	}
+
+	c := h.c
+	c.spinLock()
+	h.appendHeaderBlock(s, h.encBuf.Bytes(), endStream)
+	if endStream {
+		s.endLog()
+	}
+	c.spinUnlock()
+
+	if endStream {
+		s.ended = true
+		delete(h.streams, s.id)
+	}
+}
+
+// appendHeaderBlock appends the block as HEADERS and CONTINUATION frames, h.mu and c.lock must be held.
+func (h *h2Conn) appendHeaderBlock(s *h2Stream, block []byte, endStream bool) {
+	c := h.c
+	typ, flags := uint8(h2Headers), uint8(0)
+	if endStream {
+		flags = h2FlagEndStream
+	}
+	for {
+		n := len(block)
+		if n > h.maxFrame {
+			n = h.maxFrame
+		} else {
+			flags |= h2FlagEndHeaders
+		}
+		c.out = h2AppendFrame(c.out, typ, flags, s.id, block[:n])
+		s.sent += 9 + n
+		if block = block[n:]; len(block) == 0 {
+			break
+		}
+		typ, flags = h2Continuation, 0
+	}
+}
+
+// writeTrailers ends the stream with trailers once pending data is sent.
+func (s *h2Stream) writeTrailers(trailers [][2]string) {
+	h := s.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s.reset || s.ended || s.fin {
+		return
+	}
+	s.trailers, s.fin = trailers, true
+	h.flush(s)
+}
+
+// abort resets the stream whose response can't be completed.
+func (s *h2Stream) abort() {
+	h := s.h
+	h.mu.Lock()
+	ended := s.ended
+	h.c.spinLock()
+	s.endLog()
+	h.c.spinUnlock()
+	h.mu.Unlock()
+	if !ended {
+		h.rst(s.id, h2ErrInternal)
+	}
+}
+
+// write sends p as DATA frames, fin ends the stream.
+func (s *h2Stream) write(p string, fin bool) {
+	h := s.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s.reset || s.ended || s.fin {
+		return
+	}
+	s.pending = append(s.pending, p...)
+	s.fin = fin
+	h.flush(s)
+}
+
+// flush sends pending data allowed by flow control, h.mu must be held.
+func (h *h2Conn) flush(s *h2Stream) {
+	c := h.c
+	c.spinLock()
+	for len(s.pending) > 0 && s.window > 0 && h.window > 0 {
+		n := int64(len(s.pending))
+		if n > s.window {
+			n = s.window
+		}
+		if n > h.window {
+			n = h.window
+		}
+		if n > int64(h.maxFrame) {
+			n = int64(h.maxFrame)
+		}
+		var flags uint8
+		if int(n) == len(s.pending) && s.fin && s.trailers == nil {
+			flags, s.ended = h2FlagEndStream, true
+		}
+		c.out = h2AppendFrame(c.out, h2Data, flags, s.id, s.pending[:n])
+		s.sent += 9 + int(n)
+		s.pending = s.pending[n:]
+		s.window -= n
+		h.window -= n
+	}
+	if len(s.pending) == 0 {
+		s.pending = nil
+		if s.fin && !s.ended && s.trailers != nil {
+			h.encBuf.Reset()
+			for _, kv := range s.trailers {
+				h.enc.WriteField(hpack.HeaderField{Name: kv[0], Value: kv[1]})
+			}
+			h.appendHeaderBlock(s, h.encBuf.Bytes(), true)
+			s.ended = true
+		} else if s.fin && !s.ended {
+			c.out = h2AppendFrame(c.out, h2Data, h2FlagEndStream, s.id, nil)
+			s.sent += 9
+			s.ended = true
+		}
+	}
+	if s.ended {
+		s.endLog()
+	}
+	c.notifyDrain()
+	c.spinUnlock()
+
+	if s.ended {
+		delete(h.streams, s.id)
+	}
+}
+
+// endLog queues the access log entry of the stream, c.lock must be held.
+func (s *h2Stream) endLog() {
+	if s.log != nil {
+		s.log.BytesOut = s.sent
+		s.h.c.logAfterFlush(s.log)
+		s.log = nil
+	}
+}
+
+// waitDrain blocks until data blocked by flow control and the pending output are small enough.
+func (s *h2Stream) waitDrain() bool {
+	c := s.h.c
+	for c.closed.Load() == 0 {
+		s.h.mu.Lock()
+		pending, reset := len(s.pending), s.reset
+		s.h.mu.Unlock()
+		if reset {
+			return false
+		}
+		if pending < StreamDrainBytes {
+			return c.waitDrain(StreamDrainBytes)
+		}
+
+		c.spinLock()
+		if c.drain == nil {
+			c.drain = make(chan struct{}, 1)
+		}
+		ch := c.drain
+		c.spinUnlock()
+
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+		}
+	}
+	return false
+}
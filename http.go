@@ -3,8 +3,12 @@ package resh
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
@@ -23,18 +27,58 @@ type HTTP struct {
 	Host      string
 	Path      string
 	qmap      *plru.Map[string, string]
+	form      [][2]string
+	query     [][2]string
 	data      []byte
 	qStart    uint16
 	qEnd      uint16
+	hdrs      [][4]uint32 // [[key start, key end, value start, value end] ...]
 	hdrLen    uint32
 	bodyLen   uint32
+	minor     uint8 // HTTP/1.x
+	acceptEnc uint8 // bitmask of accepted encodings
+	enc       uint8 // response encoding
+	vary      bool  // the response varies by Accept-Encoding
 	wsUpgrade bool
+	h2c       bool // 'Upgrade: h2c'
+	closeConn bool
+	expect100 bool
 	chunked   bool
+	fixedLen  bool // StartStream with a known size, Write sends the body as is
+	noBody    bool // responding to HEAD or with 1xx, 204 or 304, the body is discarded
 	chkbuf    []byte
+	zw        compressor
+	resHdr    [][2]string // headers added by helpers
+	h2        *h2Stream
+	log       *AccessEntry
+	reqID     string
+	identity  any // resolved by Auth
+	clientIP  string
+	target    string // raw request target for the access log
 }
 
+func (r *HTTP) Proto() string {
+	if r.h2 != nil {
+		return "HTTP/2.0"
+	}
+	if r.minor == 0 {
+		return "HTTP/1.0"
+	}
+	return "HTTP/1.1"
+}
+
+// KeepAlive reports whether the connection will be reused after the response.
+func (r *HTTP) KeepAlive() bool {
+	return !r.closeConn
+}
+
+// Method returns the upper-cased method, or "" if the request is not parsed.
 func (r *HTTP) Method() string {
-	method := r.data[:bytes.IndexByte(r.data, ' ')]
+	idx := bytes.IndexByte(r.data, ' ')
+	if idx < 0 {
+		return ""
+	}
+	method := r.data[:idx]
 	for i, c := range method {
 		if 'a' <= c && c <= 'z' {
 			method[i] = c - 'a' + 'A'
@@ -47,22 +91,52 @@ func (r *HTTP) Body() []byte {
 	return r.data[len(r.data)-int(r.bodyLen):]
 }
 
-func (r *HTTP) parse() error {
+// parse parses the request line and headers. Strict parsing follows RFC 9112
+// to prevent request smuggling: bare CR or LF, obs-fold, invalid tokens,
+// whitespace before colons, repeated Content-Length or Host are rejected.
+// Transfer-Encoding is rejected in both modes, chunked request bodies are not
+// supported and must not be framed differently from front proxies.
+func (r *HTTP) parse(ln *Listener, strict bool) error {
 	r.hdrLen = uint32(len(r.data))
+	r.minor = 1
+	var keepAlive, hasCL, hasHost, hasTE bool
 	for start := 0; start < len(r.data); {
 		idx := bytes.Index(r.data[start:], crlf)
 		if idx == 0 {
 			break
 		}
 		line := r.data[start : start+idx]
+		if strict && bytes.IndexAny(line, "\r\n") >= 0 {
+			return &httpError{400, fmt.Errorf("bare CR or LF in %q", line)}
+		}
 
 		if start == 0 {
 			idx0, idx1 := bytes.IndexByte(line, ' '), bytes.LastIndexByte(line, ' ') // <Method><WS><Path><WS><Version>
-			if idx0 == -1 || idx1 == -1 || idx0 == idx1 || idx1 > 0xffff {
-				return fmt.Errorf("invalid HTTP/1 first line: %q", line)
+			if idx0 == -1 || idx1 == -1 || idx0 == idx1 {
+				return &httpError{400, fmt.Errorf("invalid HTTP/1 first line: %q", line)}
+			}
+			if idx1 > 0xffff {
+				return &httpError{414, fmt.Errorf("URI too long: %db", idx1-idx0-1)}
+			}
+
+			if strict && !validRequestLine(line[:idx0], line[idx0+1:idx1]) {
+				return &httpError{400, fmt.Errorf("invalid HTTP/1 first line: %q", line)}
+			}
+
+			switch version := btos(line[idx1+1:]); {
+			case version == "HTTP/1.0":
+				r.minor = 0
+			case len(version) == 8 && strings.HasPrefix(version, "HTTP/1.") && '0' <= version[7] && version[7] <= '9':
+			case len(version) == 8 && strings.HasPrefix(version, "HTTP/") && version[6] == '.':
+				return &httpError{505, fmt.Errorf("unsupported HTTP version %q", version)}
+			default:
+				return &httpError{400, fmt.Errorf("invalid HTTP version %q", version)}
 			}
 
 			uri := line[idx0+1 : idx1]
+			if ln.AccessLog != nil {
+				r.target = string(uri)
+			}
 			if q := bytes.IndexByte(uri, '?'); q >= 0 {
 				r.qStart = uint16(idx0 + 1 + q + 1)
 				r.qEnd = uint16(idx1)
@@ -73,123 +147,159 @@ func (r *HTTP) parse() error {
 			if !strings.HasPrefix(r.Path, "/") {
 				u, err := url.Parse(r.Path)
 				if err != nil {
-					return fmt.Errorf("invalid HTTP/1 path %q: %v", line, err)
+					return &httpError{400, fmt.Errorf("invalid HTTP/1 path %q: %v", line, err)}
 				}
 				r.Path, r.Host = u.Path, u.Host
 			}
 		} else {
 			idx := bytes.IndexByte(line, ':')
 			if idx < 1 {
-				return fmt.Errorf("invalid HTTP/1 header: %q", line)
+				return &httpError{400, fmt.Errorf("invalid HTTP/1 header: %q", line)}
+			}
+			if strict && (line[0] == ' ' || line[0] == '\t') {
+				return &httpError{400, fmt.Errorf("obsolete line folding: %q", line)}
+			}
+			if strict && (!validHeaderName(btos(line[:idx])) || !validHeaderValue(btos(line[idx+1:]))) {
+				return &httpError{400, fmt.Errorf("invalid HTTP/1 header: %q", line)}
+			}
+			if len(r.hdrs) >= ln.HTTPMaxHeaders {
+				return &httpError{431, fmt.Errorf("too many headers")}
 			}
 			key := line[:idx]
 			for i, c := range key {
-				if c == ':' {
-					break
-				}
 				if 'A' <= c && c <= 'Z' {
 					key[i] = c - 'A' + 'a'
 				}
 			}
-			value := bytes.TrimSpace(line[idx+1:])
+			vs, ve := idx+1, len(line)
+			for vs < ve && (line[vs] == ' ' || line[vs] == '\t') {
+				vs++
+			}
+			for ve > vs && (line[ve-1] == ' ' || line[ve-1] == '\t') {
+				ve--
+			}
+			value := line[vs:ve]
+			r.hdrs = append(r.hdrs, [4]uint32{uint32(start), uint32(start + idx), uint32(start + vs), uint32(start + ve)})
 			switch btos(key) {
 			case "upgrade":
 				r.wsUpgrade = strings.EqualFold(btos(value), "websocket")
+				r.h2c = strings.EqualFold(btos(value), "h2c")
 			case "host":
-				r.Host = btos(value)
+				if strict && hasHost {
+					return &httpError{400, fmt.Errorf("multiple Host headers")}
+				}
+				r.Host, hasHost = btos(value), true
+			case "connection":
+				for v := btos(value); v != ""; {
+					var tok string
+					tok, v, _ = strings.Cut(v, ",")
+					tok = strings.TrimSpace(tok)
+					if strings.EqualFold(tok, "close") {
+						r.closeConn = true
+					} else if strings.EqualFold(tok, "keep-alive") {
+						keepAlive = true
+					}
+				}
+			case "accept-encoding":
+				r.acceptEnc = parseAcceptEncoding(btos(value))
+			case "expect":
+				r.expect100 = strings.EqualFold(btos(value), "100-continue")
+			case "transfer-encoding":
+				hasTE = true
 			case "content-length":
+				if strict && (hasCL || !isDigits(value)) {
+					return &httpError{400, fmt.Errorf("invalid or repeated Content-Length %q", value)}
+				}
+				hasCL = true
 				cl, err := strconv.Atoi(btos(value))
-				if cl > RequestMaxBytes || cl < 0 || err != nil {
-					return fmt.Errorf("invalid Content-Length %q", value)
+				if cl < 0 || err != nil {
+					return &httpError{400, fmt.Errorf("invalid Content-Length %q", value)}
+				}
+				if cl > math.MaxInt32 {
+					return &httpError{413, fmt.Errorf("request body too large: %db", cl)}
 				}
 				r.bodyLen = uint32(cl)
 			}
 		}
 		start += idx + 2
 	}
+	if hasTE && hasCL {
+		return &httpError{400, fmt.Errorf("both Transfer-Encoding and Content-Length")}
+	}
+	if hasTE {
+		// Don't let chunked bodies be read as the next request.
+		return &httpError{501, fmt.Errorf("unsupported Transfer-Encoding")}
+	}
+	if strict && r.minor == 1 && !hasHost {
+		return &httpError{400, fmt.Errorf("missing Host header")}
+	}
+	if r.minor == 0 && !keepAlive {
+		r.closeConn = true
+	}
+	if r.minor == 0 {
+		r.expect100 = false
+	}
 	return nil
 }
 
 func (r *HTTP) URL() *url.URL {
 	u := &url.URL{
-		Scheme: "http:",
+		Scheme: "http",
 		Host:   r.Host,
 		Path:   r.Path,
 	}
-	r.ForeachQuery(func(k string, v string) {
-		u.RawQuery += url.QueryEscape(k) + "=" + url.QueryEscape(v) + "&"
-	})
+	if r.Conn != nil && r.Conn.ssl != nil {
+		u.Scheme = "https"
+	}
+	u.RawQuery = strings.Clone(r.RawQuery())
 	return u
 }
 
-func (r *HTTP) ForeachHeader(f func(k, v string) bool) {
-	for start := 0; start < len(r.data); {
-		idx := bytes.Index(r.data[start:], crlf)
-		if idx == 0 {
-			break
-		} else if start == 0 {
-		} else {
-			line := r.data[start : start+idx]
-			if idx := bytes.IndexByte(line, ':'); idx > 0 {
-				key, value := line[:idx], bytes.TrimSpace(line[idx+1:])
-				if !f(btos(key), btos(value)) {
-					return
-				}
-			}
-		}
-		start += idx + 2
+// RawQuery returns the query string of the request without '?'.
+func (r *HTTP) RawQuery() string {
+	if r.qStart == 0 {
+		return ""
 	}
+	return btos(r.data[r.qStart:r.qEnd])
 }
 
-func (r *HTTP) GetHeader(key string) (value string) {
-	r.ForeachHeader(func(k, v string) bool {
-		if k == key {
-			value = v
-			return false
+// ForeachHeader iterates all request headers until f returns false, keys are lowercased.
+func (r *HTTP) ForeachHeader(f func(k, v string) bool) {
+	for _, h := range r.hdrs {
+		if !f(btos(r.data[h[0]:h[1]]), btos(r.data[h[2]:h[3]])) {
+			return
 		}
-		return true
-	})
-	return
-}
-
-func (r *HTTP) ForeachQuery(f func(k string, v string)) {
-	if r.qStart == 0 {
-		return
-	}
-	for query := r.data[r.qStart:r.qEnd]; len(query) > 0; {
-		var part []byte
-		part, query, _ = bytes.Cut(query, []byte("&"))
-		key, value, _ := bytes.Cut(part, []byte("="))
-		f(btos(UnescapeInplace(key, true)), btos(UnescapeInplace(value, true)))
 	}
 }
 
-func (r *HTTP) Query() *plru.Map[string, string] {
-	if r.qmap != nil {
-		return r.qmap
-	}
-	if r.qStart > 0 {
-		r.qmap = plru.NewMap[string, string](4, plru.Hash.Str)
-		r.ForeachQuery(func(k string, v string) { r.qmap.Set(k, v) })
-		return r.qmap
+// GetHeader returns the first value of the header, key is case-insensitive.
+func (r *HTTP) GetHeader(key string) string {
+	for _, h := range r.hdrs {
+		if strings.EqualFold(btos(r.data[h[0]:h[1]]), key) {
+			return btos(r.data[h[2]:h[3]])
+		}
 	}
-	return nil
+	return ""
 }
 
-func (r *HTTP) GetQuery(k string) string {
-	return r.Query().Get(k)
-}
-
-func (r *HTTP) GetQueryInt64(k string) (int64, error) {
-	return strconv.ParseInt(r.Query().Get(k), 10, 64)
+// HeaderValues returns all values of the header, key is case-insensitive.
+func (r *HTTP) HeaderValues(key string) (res []string) {
+	for _, h := range r.hdrs {
+		if strings.EqualFold(btos(r.data[h[0]:h[1]]), key) {
+			res = append(res, btos(r.data[h[2]:h[3]]))
+		}
+	}
+	return
 }
 
-func (r *HTTP) GetQueryInt64Default(k string, v int64) int64 {
-	res, err := strconv.ParseInt(r.Query().Get(k), 10, 64)
-	if err != nil {
-		res = v
+// Headers returns a copy of all request headers with canonical keys.
+func (r *HTTP) Headers() http.Header {
+	hdr := make(http.Header, len(r.hdrs))
+	for _, h := range r.hdrs {
+		k := http.CanonicalHeaderKey(string(r.data[h[0]:h[1]]))
+		hdr[k] = append(hdr[k], string(r.data[h[2]:h[3]]))
 	}
-	return res
+	return hdr
 }
 
 func (r *HTTP) Flush() *HTTP {
@@ -198,14 +308,7 @@ func (r *HTTP) Flush() *HTTP {
 }
 
 func (r *HTTP) Redirect(code int, location string) *HTTP {
-	r.Conn._writeString("HTTP/1.1 ")
-	r.Conn._writeInt(int64(code), 10)
-	r.Conn._writeString(" ")
-	r.Conn._writeString(http.StatusText(code))
-	r.Conn._writeString("\r\nLocation: ")
-	r.Conn._writeString(location)
-	r.Conn._writeString("\r\n\r\n")
-	return r
+	return r.respFull(code, "", http.Header{"Location": []string{location}}, "")
 }
 
 func (r *HTTP) Text(code int, msg string) *HTTP {
@@ -224,39 +327,295 @@ func (r *HTTP) resp0(code int, contentType string, hdr http.Header) {
 	if code == 0 {
 		code = 200
 	}
-	r.Conn._writeString("HTTP/1.1 ")
-	r.Conn._writeInt(int64(code), 10)
-	r.Conn._writeString(" ")
-	r.Conn._writeString(http.StatusText(code))
-	if contentType == "" {
-		contentType = "text/plain; charset=utf-8"
+	if r.log != nil {
+		r.log.Status = code
+	}
+	if r.h2 != nil {
+		r.h2.begin(code)
+	} else {
+		r.Conn._writeString("HTTP/1.1 ")
+		r.Conn._writeInt(int64(code), 10)
+		r.Conn._writeString(" ")
+		r.Conn._writeString(http.StatusText(code))
+	}
+	if bodyAllowed(code) {
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		r.rawHeader("Content-Type", contentType)
+	}
+	if r.enc != encIdentity {
+		r.rawHeader("Content-Encoding", encNames[r.enc])
+	}
+	if r.vary {
+		r.rawHeader("Vary", "Accept-Encoding")
+	}
+	r.commonHeaders(hdr)
+	for _, kv := range r.resHdr {
+		r.writeHeader(kv[0], kv[1])
 	}
-	r.Conn._writeString("\r\nContent-Type: ")
-	r.Conn._writeString(contentType)
 	for k, v := range hdr {
 		switch k {
 		case "Content-Type", "Connection", "Content-Length", "Transfer-Encoding":
+		case "Content-Encoding":
+			if r.enc == encIdentity {
+				// The body has been encoded by the caller.
+				for _, v := range v {
+					r.writeHeader(k, v)
+				}
+			}
 		default:
-			r.Conn._writeString("\r\n")
-			r.Conn._writeString(k)
-			r.Conn._writeString(": ")
-			r.Conn._writeString(v[0])
+			for _, v := range v {
+				r.writeHeader(k, v)
+			}
 		}
 	}
 }
 
-func (r *HTTP) respFull(code int, contentType string, hdr http.Header, data string) *HTTP {
+// writeHeader writes '\r\n<k>: <v>', invalid headers are dropped to prevent response splitting.
+func (r *HTTP) writeHeader(k, v string) {
+	if !validHeaderName(k) || !validHeaderValue(v) {
+		r.Conn.ln.OnError(Error{Type: "header", Cause: fmt.Errorf("invalid response header %q: %q", k, v)})
+		return
+	}
+	r.rawHeader(k, v)
+}
+
+// rawHeader writes a header without validation, HTTP/2 streams collect it for the HEADERS frame.
+func (r *HTTP) rawHeader(k, v string) {
+	if r.h2 != nil {
+		r.h2.header(k, v)
+		return
+	}
+	r.Conn._writeString("\r\n")
+	r.Conn._writeString(k)
+	r.Conn._writeString(": ")
+	r.Conn._writeString(v)
+}
+
+// commonHeaders writes Date and Server headers unless they are provided in hdr.
+func (r *HTTP) commonHeaders(hdr http.Header) {
+	if _, ok := hdr["Date"]; !ok {
+		r.rawHeader("Date", r.Conn.ln.httpDate())
+	}
+	if _, ok := hdr["Server"]; !ok && !r.Conn.ln.NoServerHeader && r.Conn.ln.ServerName != "" {
+		r.writeHeader("Server", r.Conn.ln.ServerName)
+	}
+}
+
+func validHeaderName(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if !isTokenChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validRequestLine validates the method token and the request target, which
+// can't contain whitespaces or control characters.
+func validRequestLine(method, target []byte) bool {
+	if !validHeaderName(btos(method)) || len(target) == 0 {
+		return false
+	}
+	for _, c := range target {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(v []byte) bool {
+	for _, c := range v {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(v) > 0
+}
+
+func validHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < 0x20 && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *HTTP) connHeader() {
+	if r.h2 != nil {
+		return
+	}
+	if r.closeConn {
+		r.Conn._writeString("\r\nConnection: close")
+	} else {
+		r.Conn._writeString("\r\nConnection: keep-alive")
+	}
+}
+
+// done marks the end of the response, the connection will be closed
+// once the output is flushed if keep-alive is not wanted by the client.
+func (r *HTTP) done() {
+	r.endLog()
+	if r.h2 != nil {
+		r.h2.write("", true)
+		return
+	}
+	if r.closeConn {
+		r.Conn.closeAfterFlush()
+	}
+	c := r.Conn
+	c.spinLock()
+	resume := c.async.CompareAndSwap(r, nil) && c.resume.Load()
+	c.spinUnlock()
+	if resume {
+		c.Flush() // the loop parses buffered inputs after writing
+	}
+}
+
+func (r *HTTP) addHeader(k, v string) {
+	r.resHdr = append(r.resHdr, [2]string{k, v})
+}
+
+// respHeaders writes the response headers, the body of the given size should be written by the caller.
+func (r *HTTP) respHeaders(code int, contentType string, hdr http.Header, size int64) {
 	r.resp0(code, contentType, hdr)
-	r.Conn._writeString("\r\nConnection: Keep-Alive\r\nContent-Length: ")
-	r.Conn._writeInt(int64(len(data)), 10)
+	r.connHeader()
+	hasBody := bodyAllowed(code)
+	r.noBody = !hasBody || r.Method() == "HEAD"
+	if r.h2 != nil {
+		if hasBody {
+			r.h2.header("content-length", strconv.FormatInt(size, 10))
+		}
+		r.h2.writeHeaders(r.noBody || size == 0)
+		return
+	}
+	if hasBody {
+		r.Conn._writeString("\r\nContent-Length: ")
+		r.Conn._writeInt(size, 10)
+	}
 	r.Conn._writeString("\r\n\r\n")
-	r.Conn._writeString(data)
+}
+
+func bodyAllowed(code int) bool {
+	return code >= 200 && code != 204 && code != 304
+}
+
+// respFull writes the whole response, HEAD requests get the headers only.
+func (r *HTTP) respFull(code int, contentType string, hdr http.Header, data string) *HTTP {
+	r.enc = r.negotiateEncoding(code, contentType, hdr, len(data))
+	if r.Conn.ln.AutoETag && code == 200 && hdr.Get("ETag") == "" {
+		if m := r.Method(); m == "GET" || m == "HEAD" {
+			sum := sha256.Sum256(unsafe.Slice(unsafe.StringData(data), len(data)))
+			etag := "\"" + hex.EncodeToString(sum[:16])
+			if r.enc != encIdentity {
+				etag += "-" + encNames[r.enc] // a different representation
+			}
+			etag += "\""
+			r.addHeader("ETag", etag)
+			if inm := r.GetHeader("if-none-match"); inm != "" && etagMatch(inm, etag, true) {
+				r.enc = encIdentity
+				r.respHeaders(304, "", hdr, 0)
+				r.done()
+				return r
+			}
+		}
+	}
+	var zbuf *bytes.Buffer
+	if r.enc != encIdentity {
+		zbuf = r.compress(data)
+		data = btos(zbuf.Bytes())
+	}
+	r.respHeaders(code, contentType, hdr, int64(len(data)))
+	r.writeBody(data)
+	if zbuf != nil {
+		compressBufPool.Put(zbuf)
+	}
+	r.done()
 	return r
 }
 
+// writeBody writes a part of the body whose size has been sent by respHeaders.
+func (r *HTTP) writeBody(p string) {
+	if r.noBody {
+		return
+	}
+	if r.h2 != nil {
+		r.h2.write(p, false)
+	} else {
+		r.Conn._writeString(p)
+	}
+}
+
+// waitDrain blocks streaming writers until the pending output is small enough,
+// it returns false if the client has gone.
+func (r *HTTP) waitDrain() bool {
+	if r.h2 != nil {
+		return r.h2.waitDrain()
+	}
+	return r.Conn.waitDrain(StreamDrainBytes)
+}
+
+// WaitDrain blocks until the pending output is shorter than StreamDrainBytes,
+// it returns false if the client has gone. Don't call it in the loop goroutine.
+func (r *HTTP) WaitDrain() bool {
+	return r.waitDrain()
+}
+
+// Buffered returns the size of the output not yet written to the client.
+func (r *HTTP) Buffered() int {
+	n := 0
+	if s := r.h2; s != nil {
+		s.h.mu.Lock()
+		n = len(s.pending)
+		s.h.mu.Unlock()
+	}
+	c := r.Conn
+	c.spinLock()
+	n += len(c.out)
+	c.spinUnlock()
+	return n
+}
+
+// StartStream starts a response whose body of the given size will be written
+// by Write and ended by FinishChunked, the body is chunked if size < 0.
+func (r *HTTP) StartStream(code int, contentType string, hdr http.Header, size int64) {
+	if size < 0 {
+		r.StartChunked(code, contentType, hdr)
+		return
+	}
+	r.respHeaders(code, contentType, hdr, size)
+	r.chunked, r.fixedLen = true, true
+}
+
+// StartChunked starts a chunked response. HTTP/1.0 clients don't understand
+// chunked encoding, so the body will be sent as is and the connection will be
+// closed after FinishChunked.
 func (r *HTTP) StartChunked(code int, contentType string, hdr http.Header) {
+	if r.enc = r.negotiateEncoding(code, contentType, hdr, -1); r.enc != encIdentity {
+		r.zw = r.Conn.ln.compressors.get(r.Conn.ln.Compression, r.enc, (*chunkedSink)(r))
+	}
 	r.resp0(code, contentType, hdr)
-	r.Conn._writeString("\r\nConnection: Keep-Alive\r\nTransfer-Encoding: chunked\r\n\r\n")
+	r.noBody = !bodyAllowed(code) || r.Method() == "HEAD"
+	if r.h2 != nil {
+		r.h2.writeHeaders(r.noBody)
+	} else if !bodyAllowed(code) {
+		// 1xx, 204 and 304 can't have Transfer-Encoding, nor a body to delimit.
+		r.connHeader()
+		r.Conn._writeString("\r\n\r\n")
+	} else if r.minor == 0 {
+		r.closeConn = true
+		r.connHeader()
+		r.Conn._writeString("\r\n\r\n")
+	} else {
+		r.connHeader()
+		r.Conn._writeString("\r\nTransfer-Encoding: chunked\r\n\r\n")
+	}
 	r.chunked = true
 }
 
@@ -276,6 +635,9 @@ func (w *HTTP) Write(p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
+	if w.zw != nil {
+		return w.zw.Write(p)
+	}
 	if len(p) <= 4 || len(w.chkbuf) > 0 {
 		w.chkbuf = append(w.chkbuf, p...)
 		if len(w.chkbuf) >= 64 {
@@ -289,53 +651,200 @@ func (w *HTTP) Write(p []byte) (int, error) {
 }
 
 func (w *HTTP) writeChunked(p []byte) {
-	w.Conn._writeInt(int64(len(p)), 16)
-	w.Conn._writeString("\r\n")
-	w.Conn.Write(p)
-	w.Conn._writeString("\r\n")
+	if w.noBody {
+		return
+	}
+	if w.h2 != nil {
+		w.h2.write(btos(p), false)
+	} else if w.minor == 0 || w.fixedLen {
+		w.Conn.Write(p)
+	} else {
+		w.Conn._writeInt(int64(len(p)), 16)
+		w.Conn._writeString("\r\n")
+		w.Conn.Write(p)
+		w.Conn._writeString("\r\n")
+	}
 	if len(w.Conn.out) >= 16*1024 {
 		w.Flush()
 	}
 }
 
 func (w *HTTP) FinishChunked() {
+	w.FinishChunkedWithTrailers(nil)
+}
+
+// FinishChunkedWithTrailers ends the chunked response with trailers, which
+// should be announced by the Trailer header in StartChunked. Trailers are
+// dropped if the body is not chunked, i.e. HTTP/1.0 clients or StartStream
+// with a known size.
+func (w *HTTP) FinishChunkedWithTrailers(trailers http.Header) {
 	if !w.chunked {
 		panic("not in chunked mode, call StartChunked first")
 	}
+	if w.zw != nil {
+		w.zw.Close()
+		w.Conn.ln.compressors.put(w.enc, w.zw)
+		w.zw = nil
+	}
 	if len(w.chkbuf) > 0 {
 		w.writeChunked(w.chkbuf)
 		w.chkbuf = w.chkbuf[:0]
 	}
-	w.Conn._writeString("0\r\n\r\n")
-	w.chunked = false
+	var kvs [][2]string
+	if !w.fixedLen && !w.noBody {
+		for k, v := range trailers {
+			for _, v := range v {
+				if !validHeaderName(k) || !validHeaderValue(v) {
+					w.Conn.ln.OnError(Error{Type: "header", Cause: fmt.Errorf("invalid response trailer %q: %q", k, v)})
+					continue
+				}
+				kvs = append(kvs, [2]string{k, v})
+			}
+		}
+	}
+	if w.h2 != nil && len(kvs) > 0 {
+		for i := range kvs {
+			kvs[i][0] = strings.ToLower(kvs[i][0])
+		}
+		w.h2.writeTrailers(kvs)
+	} else if w.minor > 0 && w.h2 == nil && !w.fixedLen && !w.noBody {
+		w.Conn._writeString("0\r\n")
+		for _, kv := range kvs {
+			w.Conn._writeString(kv[0])
+			w.Conn._writeString(": ")
+			w.Conn._writeString(kv[1])
+			w.Conn._writeString("\r\n")
+		}
+		w.Conn._writeString("\r\n")
+	}
+	w.chunked, w.fixedLen = false, false
+	w.done()
 	w.Flush()
 }
 
+// StreamFrom copies rd to the response started by StartChunked or StartStream
+// in a new goroutine and finishes the response, rd is closed at the end if it
+// is an io.Closer. The next chunk is read only after the output drains below
+// StreamDrainBytes, so memory stays bounded for streams of any size. If rd
+// fails, the response is truncated by closing the connection or resetting the
+// HTTP/2 stream.
+func (r *HTTP) StreamFrom(rd io.Reader) {
+	if !r.chunked {
+		panic("not in chunked mode, call StartChunked first")
+	}
+	go func() {
+		if c, ok := rd.(io.Closer); ok {
+			defer c.Close()
+		}
+		buf := fileCopyBufferPool.Get().([]byte)
+		defer fileCopyBufferPool.Put(buf)
+		for {
+			n, err := rd.Read(buf)
+			if n > 0 {
+				r.Write(buf[:n])
+				r.Flush()
+			}
+			if err == io.EOF {
+				r.FinishChunked()
+				return
+			}
+			if err != nil {
+				r.Conn.ln.OnError(Error{Type: "stream", Cause: err})
+				r.Abort()
+				return
+			}
+			if !r.waitDrain() {
+				r.Abort()
+				return
+			}
+		}
+	}()
+}
+
+// Abort truncates the response which can't be completed, e.g. its source fails
+// after the headers have been sent. The stream is reset on HTTP/2, the
+// connection is closed on HTTP/1.
+func (r *HTTP) Abort() {
+	r.zw, r.chunked, r.fixedLen = nil, false, false
+	if r.h2 != nil {
+		r.h2.abort()
+	} else {
+		r.endLog()
+		r.Conn.closeAfterFlush()
+	}
+	r.Flush()
+}
+
 func (w *HTTP) UpgradeWebsocket(hdr http.Header) *Websocket {
 	if !w.wsUpgrade {
 		return nil
 	}
-	w.Conn.ws = &Websocket{Conn: w.Conn}
+	w.Conn.async.CompareAndSwap(w, nil)
+	w.Conn.ws = &Websocket{Conn: w.Conn, log: w.log, max: w.Conn.ln.wsMaxBytes()}
+	if w.log != nil {
+		w.log.Status = 101
+		w.log = nil
+	}
 	key := w.GetHeader("sec-websocket-key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 	h := sha1.Sum([]byte(key))
 	w.Conn._writeString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
 	w.Conn._writeString(base64.StdEncoding.EncodeToString(h[:]))
-	w.Conn._writeString("\r\n")
+	w.commonHeaders(hdr)
+	for _, kv := range w.resHdr {
+		w.writeHeader(kv[0], kv[1])
+	}
 	for k, v := range hdr {
 		switch k {
 		case "Upgrade", "Connection", "Sec-WebSocket-Accept":
 		default:
-			w.Conn._writeString(k)
-			w.Conn._writeString(": ")
-			w.Conn._writeString(v[0])
-			w.Conn._writeString("\r\n")
+			for _, v := range v {
+				w.writeHeader(k, v)
+			}
 		}
 	}
-	w.Conn._writeString("\r\n")
+	w.Conn._writeString("\r\n\r\n")
 	w.Conn.Flush()
 	return w.Conn.ws
 }
 
+// Tunnel responds to an upgrade request and switches the connection to raw mode,
+// following outputs are written by Conn.Write. Inputs are passed to onData in
+// the loop goroutine, onData(nil) is called once the connection is closed.
+func (r *HTTP) Tunnel(code int, hdr http.Header, onData func([]byte)) error {
+	if r.h2 != nil {
+		return fmt.Errorf("tunneling is not supported by HTTP/2")
+	}
+	c := r.Conn
+	if r.log != nil {
+		r.log.Status = code
+	}
+	c._writeString("HTTP/1.1 ")
+	c._writeInt(int64(code), 10)
+	c._writeString(" ")
+	c._writeString(http.StatusText(code))
+	for _, kv := range r.resHdr {
+		r.writeHeader(kv[0], kv[1])
+	}
+	for k, v := range hdr {
+		for _, v := range v {
+			r.writeHeader(k, v)
+		}
+	}
+	c._writeString("\r\n\r\n")
+	r.endLog()
+
+	c.spinLock()
+	in := c.in
+	c.in, c.raw = nil, onData
+	c.spinUnlock()
+	c.OnClose(func() { onData(nil) })
+	if len(in) > 0 {
+		onData(in)
+	}
+	c.Flush()
+	return nil
+}
+
 func RunPprof(sh *HTTP) {
 	switch {
 	case strings.HasPrefix(sh.Path, "/debug/pprof/cmdline"):
@@ -351,31 +860,7 @@ func RunPprof(sh *HTTP) {
 	}
 }
 
-func (sh *HTTP) RunGoHandler(h http.HandlerFunc) {
-	r := http.Request{}
-	r.URL = sh.URL()
-	r.RequestURI = r.URL.String()
-	r.Method = sh.Method()
-	r.ProtoMajor = 1
-	r.ProtoMinor = 1
-	r.Host = sh.Host
-	r.Header = make(http.Header)
-
-	sh.ForeachHeader(func(sk string, v string) bool {
-		switch sk {
-		case "transfer-encoding":
-			r.TransferEncoding = append(r.TransferEncoding, v)
-		default:
-			r.Header.Set(sk, v)
-		}
-		return true
-	})
-
-	w := netHTTPResponseWriter{}
-	h(&w, &r)
-	sh.BytesHeaders(w.code, w.h.Get("Content-Type"), w.h, w.w.Bytes()).Flush()
-}
-
+// Release reuses the input buffer, call it in OnHTTP, not from goroutines.
 func (r *HTTP) Release() {
 	r.Conn.ReuseInputBuffer(r.data)
 }
@@ -0,0 +1,711 @@
+//go:build darwin || netbsd || freebsd || openbsd || dragonfly || linux
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+// Package httpc is a non-blocking HTTP/1.1 client running on its own event loop.
+package httpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coyove/resh"
+	"github.com/coyove/resh/internal"
+)
+
+var (
+	ResponseMaxBytes = 8 * 1024 * 1024
+	MaxRedirects     = 10
+	ErrTimeout       = fmt.Errorf("httpc: request timed out")
+)
+
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header http.Header
+	Body   []byte
+
+	// Stream, if set, makes Do call back once the response headers arrive, the
+	// body is then passed to Stream part by part in the loop goroutine and
+	// Stream(nil, err) marks the end, err is nil if the body is complete. The
+	// end may be reported in the goroutine calling Client.Close instead.
+	// Returning false pauses reading the response until Response.Resume is
+	// called. Redirects are not followed and Client.Timeout only covers the
+	// headers. After 101 Switching Protocols, all inputs are streamed until
+	// the connection is closed, see Response.Write.
+	Stream func(p []byte, err error) bool
+}
+
+func NewRequest(method, rawURL string, hdr http.Header, body []byte) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("httpc: unsupported scheme %q", u.Scheme)
+	}
+	if method == "" {
+		method = "GET"
+	}
+	return &Request{Method: method, URL: u, Header: hdr, Body: body}, nil
+}
+
+type Response struct {
+	StatusCode int
+	Proto      string
+	Header     http.Header
+	Body       []byte
+	Request    *Request // the last request if redirected
+
+	cl *Client
+	c  *conn // streaming connection
+}
+
+type Client struct {
+	poll   *internal.Poll
+	buffer []byte
+	mu     sync.Mutex // protects everything below, callbacks are called without it
+	conns  map[int]*conn
+	hosts  map[string]*hostPool
+	calls  []func()
+
+	// PoolSize limits connections per host, requests are queued if all connections are busy.
+	PoolSize int
+	OnError  func(resh.Error)
+	// Timeout of each request, including queueing, connecting and redirects.
+	Timeout time.Duration
+	// MaxRedirects limits redirects to follow, 0 means the package default, -1 disables redirects.
+	MaxRedirects int
+	UserAgent    string
+}
+
+type hostPool struct {
+	key   string
+	addr  syscall.Sockaddr
+	err   error
+	ready bool // address resolved
+	idle  []*conn
+	count int
+	queue []*task
+}
+
+type task struct {
+	req       *Request
+	cb        func(*Response, error)
+	timer     *time.Timer
+	conn      *conn
+	redirects int
+	retried   bool
+	done      bool
+}
+
+type conn struct {
+	fd      int
+	pool    *hostPool
+	task    *task
+	in      []byte
+	out     []byte
+	closed  bool
+	reused  bool
+	written bool // some bytes of the request have been written
+	paused  bool // reading is paused by Request.Stream
+
+	// response being parsed
+	resp       *Response
+	streaming  bool
+	hdrLen     int
+	bodyLen    int // -1: chunked, -2: until closed
+	chunkOff   int
+	body       []byte
+	closeAfter bool
+}
+
+func NewClient(poolSize int) *Client {
+	cl := &Client{
+		poll:      internal.OpenPoll(),
+		buffer:    make([]byte, 0xFFFF),
+		conns:     map[int]*conn{},
+		hosts:     map[string]*hostPool{},
+		PoolSize:  poolSize,
+		UserAgent: "resh-httpc",
+	}
+	go func() {
+		runtime.LockOSThread()
+		defer func() {
+			if r := recover(); r != nil {
+				cl.OnError(resh.Error{Type: "panic", Cause: fmt.Errorf("fatal error %v: %s", r, debug.Stack())})
+			}
+			runtime.UnlockOSThread()
+		}()
+
+		cl.poll.Wait(func(fd int, ev uint32) error {
+			cl.mu.Lock()
+			if c := cl.conns[fd]; c != nil {
+				if ev&internal.WRITE > 0 {
+					cl.writeConn(c)
+				}
+				// Errors of paused connections are reported without flags.
+				if ev&(internal.READ|internal.WRITE) != internal.WRITE && !c.closed {
+					cl.readConn(c)
+				}
+			}
+			cl.unlock()
+			return nil
+		})
+	}()
+	return cl
+}
+
+func (cl *Client) Get(url string, cb func(*Response, error)) {
+	req, err := NewRequest("GET", url, nil, nil)
+	if err != nil {
+		cb(nil, err)
+		return
+	}
+	cl.Do(req, cb)
+}
+
+func (cl *Client) Post(url, contentType string, body []byte, cb func(*Response, error)) {
+	req, err := NewRequest("POST", url, http.Header{"Content-Type": {contentType}}, body)
+	if err != nil {
+		cb(nil, err)
+		return
+	}
+	cl.Do(req, cb)
+}
+
+// Do sends the request without blocking, cb is called exactly once with the
+// response, without holding the client's lock, so it may call Do again. It is
+// usually called in the loop goroutine, but a failure is reported in the goroutine
+// noticing it: the caller of Do for invalid URLs and dial errors (before Do
+// returns), the resolver goroutine for DNS errors, the timer goroutine for
+// timeouts, or the caller of Client.Close. cb should not block in any case.
+func (cl *Client) Do(req *Request, cb func(*Response, error)) {
+	if cl.OnError == nil {
+		panic("missing OnError handler")
+	}
+	t := &task{req: req, cb: cb}
+	if cl.Timeout > 0 {
+		t.timer = time.AfterFunc(cl.Timeout, func() { cl.timeout(t) })
+	}
+	cl.mu.Lock()
+	cl.enqueue(t)
+	cl.unlock()
+}
+
+// unlock releases mu and calls pending callbacks in order.
+func (cl *Client) unlock() {
+	calls := cl.calls
+	cl.calls = nil
+	cl.mu.Unlock()
+	for _, f := range calls {
+		f()
+	}
+}
+
+func (cl *Client) finish(t *task, resp *Response, err error) {
+	if t.done {
+		return
+	}
+	t.done = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	cl.calls = append(cl.calls, func() { t.cb(resp, err) })
+}
+
+func (cl *Client) enqueue(t *task) {
+	u := t.req.URL
+	if u.Scheme != "http" || u.Host == "" {
+		cl.finish(t, nil, fmt.Errorf("httpc: unsupported URL %q", u))
+		return
+	}
+	key := u.Host
+	if u.Port() == "" {
+		key = net.JoinHostPort(u.Hostname(), "80")
+	}
+	p := cl.hosts[key]
+	if p == nil {
+		p = &hostPool{key: key}
+		cl.hosts[key] = p
+		go cl.resolve(p)
+	}
+	p.queue = append(p.queue, t)
+	cl.schedule(p)
+}
+
+func (cl *Client) resolve(p *hostPool) {
+	addr, err := net.ResolveTCPAddr("tcp", p.key)
+	cl.mu.Lock()
+	if err == nil {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			sa := &syscall.SockaddrInet4{Port: addr.Port}
+			copy(sa.Addr[:], ip4)
+			p.addr = sa
+		} else {
+			sa := &syscall.SockaddrInet6{Port: addr.Port}
+			copy(sa.Addr[:], addr.IP)
+			p.addr = sa
+		}
+	}
+	p.err, p.ready = err, true
+	cl.schedule(p)
+	cl.unlock()
+}
+
+// schedule assigns queued tasks to idle or new connections.
+func (cl *Client) schedule(p *hostPool) {
+	if !p.ready {
+		return
+	}
+	if p.err != nil {
+		for _, t := range p.queue {
+			cl.finish(t, nil, p.err)
+		}
+		p.queue = nil
+		delete(cl.hosts, p.key) // resolve again next time
+		return
+	}
+	for len(p.queue) > 0 {
+		var c *conn
+		if n := len(p.idle); n > 0 {
+			c, p.idle = p.idle[n-1], p.idle[:n-1]
+			c.reused = true
+		} else if p.count < cl.PoolSize || cl.PoolSize <= 0 {
+			var err error
+			if c, err = cl.dial(p); err != nil {
+				cl.finish(p.queue[0], nil, err)
+				p.queue = p.queue[1:]
+				continue
+			}
+		} else {
+			return
+		}
+		t := p.queue[0]
+		p.queue = p.queue[1:]
+		if t.done {
+			p.idle = append(p.idle, c)
+			continue
+		}
+		out, err := cl.appendRequest(c.out[:0], t.req)
+		if err != nil {
+			cl.finish(t, nil, err)
+			p.idle = append(p.idle, c)
+			continue
+		}
+		t.conn, c.task, c.written, c.out = c, t, false, out
+		if c.reused {
+			cl.poll.Trigger(c.fd)
+		}
+	}
+}
+
+func (cl *Client) dial(p *hostPool) (*conn, error) {
+	af := syscall.AF_INET
+	if _, ok := p.addr.(*syscall.SockaddrInet6); ok {
+		af = syscall.AF_INET6
+	}
+	fd, err := syscall.Socket(af, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := syscall.Connect(fd, p.addr); err != nil && err != syscall.EINPROGRESS {
+		syscall.Close(fd)
+		return nil, err
+	}
+	c := &conn{fd: fd, pool: p}
+	cl.conns[fd] = c
+	p.count++
+	cl.poll.AddReadWrite(fd)
+	return c, nil
+}
+
+func (cl *Client) appendRequest(b []byte, req *Request) ([]byte, error) {
+	if !validMethod(req.Method) {
+		return b, fmt.Errorf("httpc: invalid method %q", req.Method)
+	}
+	u := req.URL
+	b = append(append(append(b, req.Method...), ' '), u.RequestURI()...)
+	b = append(append(append(b, " HTTP/1.1\r\nHost: "...), u.Host...), "\r\n"...)
+	if _, ok := req.Header["User-Agent"]; !ok && cl.UserAgent != "" {
+		b = append(append(append(b, "User-Agent: "...), cl.UserAgent...), "\r\n"...)
+	}
+	if len(req.Body) > 0 || req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH" {
+		b = strconv.AppendInt(append(b, "Content-Length: "...), int64(len(req.Body)), 10)
+		b = append(b, "\r\n"...)
+	}
+	for k, vs := range req.Header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Host", "Content-Length", "Transfer-Encoding":
+			continue
+		}
+		for _, v := range vs {
+			if strings.ContainsAny(k, "\r\n: ") || strings.ContainsAny(v, "\r\n") {
+				continue
+			}
+			b = append(append(append(append(b, k...), ": "...), v...), "\r\n"...)
+		}
+	}
+	b = append(b, "\r\n"...)
+	return append(b, req.Body...), nil
+}
+
+// validMethod reports whether m is a token.
+func validMethod(m string) bool {
+	if m == "" {
+		return false
+	}
+	for _, r := range m {
+		if r <= 0x20 || r >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cl *Client) timeout(t *task) {
+	cl.mu.Lock()
+	if !t.done {
+		if c := t.conn; c != nil && c.task == t {
+			c.task = nil
+			cl.closeConn(c, nil)
+		}
+		cl.finish(t, nil, ErrTimeout)
+	}
+	cl.unlock()
+}
+
+// closeConn closes the connection, its task fails with err or is retried once
+// if a reused connection is closed before any response, and the request is
+// idempotent or has not been written at all.
+func (cl *Client) closeConn(c *conn, err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	delete(cl.conns, c.fd)
+	if err := syscall.Close(c.fd); err != nil {
+		cl.OnError(resh.Error{Type: "close", Cause: err})
+	}
+	p := c.pool
+	p.count--
+	for i, ic := range p.idle {
+		if ic == c {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			break
+		}
+	}
+	if t := c.task; t != nil {
+		if c.streaming {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			cl.stream(c, nil, err)
+		}
+		c.task, t.conn = nil, nil
+		if c.reused && c.resp == nil && len(c.in) == 0 && !t.retried && (!c.written || idempotent(t.req.Method)) {
+			t.retried = true
+			p.queue = append([]*task{t}, p.queue...)
+		} else {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			cl.finish(t, nil, err)
+		}
+	} else if err != nil {
+		cl.OnError(resh.Error{Type: "httpc", Cause: err})
+	}
+	cl.schedule(p)
+}
+
+func idempotent(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS" || method == "TRACE"
+}
+
+func (cl *Client) writeConn(c *conn) {
+	if len(c.out) > 0 {
+		n, err := syscall.Write(c.fd, c.out)
+		if err != nil && err != syscall.EAGAIN {
+			cl.closeConn(c, err)
+			return
+		}
+		if n > 0 {
+			c.out = c.out[n:]
+			c.written = true
+		}
+	}
+	cl.watch(c)
+}
+
+// watch updates events of the connection, reading is stopped while paused.
+func (cl *Client) watch(c *conn) {
+	switch {
+	case c.paused && len(c.out) > 0:
+		cl.poll.ModWrite(c.fd)
+	case c.paused:
+		cl.poll.ModNone(c.fd)
+	case len(c.out) > 0:
+		cl.poll.ModReadWrite(c.fd)
+	default:
+		cl.poll.ModRead(c.fd)
+	}
+}
+
+func (cl *Client) readConn(c *conn) {
+	n, err := syscall.Read(c.fd, cl.buffer)
+	if err == syscall.EAGAIN {
+		return
+	}
+	if n <= 0 || err != nil {
+		if c.task != nil && c.resp != nil && c.bodyLen == -2 {
+			// The body ends when the connection is closed.
+			resp, t := c.resp, c.task
+			if c.streaming {
+				cl.stream(c, nil, nil)
+				c.streaming = false
+			} else {
+				resp.Body = append([]byte{}, c.in[c.hdrLen:]...)
+			}
+			c.task, c.in = nil, c.in[:0]
+			cl.closeConn(c, nil)
+			cl.complete(t, resp)
+			return
+		}
+		cl.closeConn(c, err)
+		return
+	}
+	if c.task == nil {
+		cl.closeConn(c, fmt.Errorf("unexpected data from idle connection to %s", c.pool.key))
+		return
+	}
+	if c.in = append(c.in, cl.buffer[:n]...); len(c.in) > ResponseMaxBytes {
+		cl.closeConn(c, fmt.Errorf("httpc: response too large: %db", len(c.in)))
+		return
+	}
+
+	for c.resp == nil {
+		idx := bytes.Index(c.in, []byte("\r\n\r\n"))
+		if idx < 0 {
+			return
+		}
+		if err := c.parseHead(c.in[:idx+4]); err != nil {
+			cl.closeConn(c, err)
+			return
+		}
+		if c.resp.StatusCode < 200 && c.resp.StatusCode != 101 {
+			// Interim responses like 100 Continue are skipped.
+			c.in = c.in[idx+4:]
+			c.resp = nil
+		}
+	}
+	if c.task.req.Stream != nil {
+		cl.readStream(c)
+		return
+	}
+
+	var end int
+	switch c.bodyLen {
+	case -2:
+		return
+	case -1:
+		var ok bool
+		if end, ok, err = c.readChunked(); err != nil {
+			cl.closeConn(c, err)
+			return
+		} else if !ok {
+			return
+		}
+		c.resp.Body = c.body
+	default:
+		if end = c.hdrLen + c.bodyLen; len(c.in) < end {
+			return
+		}
+		c.resp.Body = append([]byte{}, c.in[c.hdrLen:end]...)
+	}
+	resp, t := c.resp, c.task
+	if end < len(c.in) {
+		// Garbage after the response, the connection can't be reused.
+		c.closeAfter = true
+	}
+	cl.release(c)
+	cl.complete(t, resp)
+}
+
+// release puts the connection back to the pool after a response.
+func (cl *Client) release(c *conn) {
+	c.task.conn = nil
+	c.task, c.resp, c.body = nil, nil, nil
+	c.streaming = false
+	if c.paused {
+		c.paused = false
+		cl.watch(c)
+	}
+	c.in = c.in[:0]
+	c.hdrLen, c.bodyLen, c.chunkOff = 0, 0, 0
+	if c.closeAfter {
+		cl.closeConn(c, nil)
+		return
+	}
+	c.pool.idle = append(c.pool.idle, c)
+	cl.schedule(c.pool)
+}
+
+func (cl *Client) complete(t *task, resp *Response) {
+	if t.done {
+		return
+	}
+	resp.Request = t.req
+	if req := cl.redirect(t, resp); req != nil {
+		t.req = req
+		t.redirects++
+		cl.enqueue(t)
+		return
+	}
+	cl.finish(t, resp, nil)
+}
+
+func (cl *Client) redirect(t *task, resp *Response) *Request {
+	switch resp.StatusCode {
+	case 301, 302, 303, 307, 308:
+	default:
+		return nil
+	}
+	max := cl.MaxRedirects
+	if max == 0 {
+		max = MaxRedirects
+	}
+	loc := resp.Header.Get("Location")
+	if t.redirects >= max || loc == "" {
+		return nil
+	}
+	u, err := t.req.URL.Parse(loc)
+	if err != nil || u.Scheme != "http" {
+		return nil
+	}
+	req := &Request{Method: t.req.Method, URL: u, Header: t.req.Header, Body: t.req.Body}
+	if resp.StatusCode == 303 && req.Method != "HEAD" || resp.StatusCode <= 302 && req.Method == "POST" {
+		req.Method, req.Body = "GET", nil
+	}
+	if u.Host != t.req.URL.Host && req.Header != nil {
+		req.Header = req.Header.Clone()
+		req.Header.Del("Authorization")
+		req.Header.Del("Cookie")
+	}
+	return req
+}
+
+func (c *conn) parseHead(head []byte) error {
+	lines := strings.Split(string(head[:len(head)-4]), "\r\n")
+	proto, status, _ := strings.Cut(lines[0], " ")
+	code, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(status, " ", 2)[0]))
+	if err != nil || !strings.HasPrefix(proto, "HTTP/1.") || code < 100 || code > 999 {
+		return fmt.Errorf("httpc: invalid status line %q", lines[0])
+	}
+	resp := &Response{StatusCode: code, Proto: proto, Header: make(http.Header, len(lines)-1)}
+	for _, line := range lines[1:] {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("httpc: invalid header %q", line)
+		}
+		resp.Header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+
+	c.resp, c.hdrLen, c.body = resp, len(head), nil
+	c.closeAfter = proto == "HTTP/1.0"
+	for _, v := range resp.Header.Values("Connection") {
+		for _, tok := range strings.Split(v, ",") {
+			switch tok = strings.TrimSpace(tok); {
+			case strings.EqualFold(tok, "close"):
+				c.closeAfter = true
+			case strings.EqualFold(tok, "keep-alive"):
+				c.closeAfter = false
+			}
+		}
+	}
+
+	switch te := strings.ToLower(resp.Header.Get("Transfer-Encoding")); {
+	case code == 101:
+		c.bodyLen, c.closeAfter = -2, true
+	case c.task.req.Method == "HEAD" || code < 200 || code == 204 || code == 304:
+		c.bodyLen = 0
+	case strings.HasSuffix(te, "chunked"):
+		c.bodyLen, c.chunkOff = -1, c.hdrLen
+	case resp.Header.Get("Content-Length") != "":
+		n, err := strconv.Atoi(resp.Header.Get("Content-Length"))
+		if err != nil || n < 0 {
+			return fmt.Errorf("httpc: invalid Content-Length %q", resp.Header.Get("Content-Length"))
+		}
+		c.bodyLen = n
+	default:
+		c.bodyLen, c.closeAfter = -2, true
+	}
+	return nil
+}
+
+// readChunked decodes chunks incrementally, it returns the end of the response once the last chunk is read.
+func (c *conn) readChunked() (int, bool, error) {
+	for {
+		in := c.in[c.chunkOff:]
+		idx := bytes.Index(in, []byte("\r\n"))
+		if idx < 0 {
+			return 0, false, nil
+		}
+		line := in[:idx]
+		if i := bytes.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+		if err != nil || size < 0 || size > int64(ResponseMaxBytes) {
+			return 0, false, fmt.Errorf("httpc: invalid chunk size %q", line)
+		}
+		if size == 0 {
+			// Trailers are discarded.
+			rest := in[idx+2:]
+			if bytes.HasPrefix(rest, []byte("\r\n")) {
+				return c.chunkOff + idx + 4, true, nil
+			}
+			if end := bytes.Index(rest, []byte("\r\n\r\n")); end >= 0 {
+				return c.chunkOff + idx + 2 + end + 4, true, nil
+			}
+			return 0, false, nil
+		}
+		end := idx + 2 + int(size)
+		if len(in) < end+2 {
+			return 0, false, nil
+		}
+		if in[end] != '\r' || in[end+1] != '\n' {
+			return 0, false, fmt.Errorf("httpc: missing CRLF after chunk data")
+		}
+		c.body = append(c.body, in[idx+2:end]...)
+		c.chunkOff += end + 2
+	}
+}
+
+func (cl *Client) String() string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return fmt.Sprintf("(hosts=%d, conns=%d)", len(cl.hosts), len(cl.conns))
+}
+
+func (cl *Client) Close() {
+	cl.mu.Lock()
+	for _, c := range cl.conns {
+		cl.closeConn(c, nil)
+	}
+	cl.unlock()
+	cl.poll.Close()
+}
@@ -0,0 +1,260 @@
+//go:build darwin || netbsd || freebsd || openbsd || dragonfly || linux
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package httpc
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/resh"
+)
+
+type Balance int
+
+const (
+	RoundRobin Balance = iota
+	LeastConn          // the upstream with the fewest requests in flight
+)
+
+// Upstream is a backend server of ReverseProxy.
+type Upstream struct {
+	URL *url.URL // http://host:port/prefix
+
+	active    int // requests in flight
+	fails     int // consecutive failures
+	downUntil time.Time
+}
+
+// ReverseProxy forwards HTTP requests and WebSocket connections to upstreams.
+type ReverseProxy struct {
+	Client    *Client
+	Upstreams []*Upstream
+	Balance   Balance
+	// MaxFails consecutive failures mark an upstream down for FailTimeout,
+	// failures are connection errors, timeouts and 502, 503 or 504 responses.
+	MaxFails    int
+	FailTimeout time.Duration
+	// Rewrite modifies the outgoing request after X-Forwarded-* headers are set, optional.
+	Rewrite func(*resh.HTTP, *Request)
+
+	mu   sync.Mutex
+	next int
+}
+
+func NewReverseProxy(cl *Client, targets ...string) (*ReverseProxy, error) {
+	p := &ReverseProxy{
+		Client:      cl,
+		MaxFails:    3,
+		FailTimeout: 10 * time.Second,
+	}
+	for _, t := range targets {
+		u, err := url.Parse(t)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("httpc: invalid upstream %q", t)
+		}
+		p.Upstreams = append(p.Upstreams, &Upstream{URL: u})
+	}
+	if len(p.Upstreams) == 0 {
+		return nil, fmt.Errorf("httpc: no upstream")
+	}
+	return p, nil
+}
+
+// hopHeaders are meaningful for a single connection and not forwarded.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// pick returns an upstream which is not marked down, or nil if all are down.
+func (p *ReverseProxy) pick(tried map[*Upstream]bool) *Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var best *Upstream
+	for i := range p.Upstreams {
+		u := p.Upstreams[(p.next+i)%len(p.Upstreams)]
+		if tried[u] || now.Before(u.downUntil) {
+			continue
+		}
+		if best == nil || p.Balance == LeastConn && u.active < best.active {
+			best = u
+		}
+		if p.Balance == RoundRobin {
+			break
+		}
+	}
+	if best != nil {
+		p.next++
+		best.active++
+	}
+	return best
+}
+
+// done records the result of a request to the upstream for passive health checks.
+func (p *ReverseProxy) done(u *Upstream, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.active--
+	if !failed {
+		u.fails = 0
+	} else if u.fails++; u.fails >= p.MaxFails {
+		u.fails = 0
+		u.downUntil = time.Now().Add(p.FailTimeout)
+	}
+}
+
+// Handle forwards the request, it can be used as Listener.OnHTTP.
+func (p *ReverseProxy) Handle(r *resh.HTTP) bool {
+	p.forward(r, strings.Clone(r.RawQuery()), map[*Upstream]bool{})
+	return true
+}
+
+func (p *ReverseProxy) forward(r *resh.HTTP, rawQuery string, tried map[*Upstream]bool) {
+	u := p.pick(tried)
+	if u == nil {
+		r.Text(502, "no upstream available").Flush()
+		return
+	}
+	tried[u] = true
+
+	target := *u.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.Path
+	target.RawPath = ""
+	target.RawQuery = rawQuery
+	req := &Request{
+		Method: r.Method(),
+		URL:    &target,
+		Header: r.Headers(),
+		Body:   r.Body(),
+	}
+	upgrade := strings.EqualFold(r.GetHeader("upgrade"), "websocket")
+	removeHopHeaders(req.Header)
+	req.Header.Del("Expect")
+	req.Header.Del("Host")
+	if upgrade {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+	}
+
+	ip, _, _ := net.SplitHostPort(r.Conn.RemoteAddr().String())
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Proto", r.URL().Scheme)
+	if id := r.RequestID(); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if p.Rewrite != nil {
+		p.Rewrite(r, req)
+	}
+
+	var resp *Response
+	var once sync.Once
+	var badStatus bool
+	finish := func(failed bool) {
+		once.Do(func() { p.done(u, failed || badStatus) })
+	}
+	req.Stream = func(b []byte, err error) bool {
+		if b == nil {
+			finish(err != nil)
+			if resp.StatusCode == 101 {
+				r.Conn.Close()
+			} else if err != nil {
+				// Headers have been sent, the response can only be truncated.
+				r.Abort()
+			} else {
+				r.FinishChunked()
+			}
+			return true
+		}
+		if resp.StatusCode == 101 {
+			r.Conn.Write(b)
+		} else {
+			r.Write(b)
+		}
+		r.Flush()
+		if r.Buffered() >= resh.StreamDrainBytes {
+			go func() {
+				if r.WaitDrain() {
+					resp.Resume()
+				} else {
+					resp.Close()
+					finish(false)
+				}
+			}()
+			return false
+		}
+		return true
+	}
+
+	p.Client.Do(req, func(res *Response, err error) {
+		if err != nil {
+			finish(true)
+			if m := r.Method(); (m == "GET" || m == "HEAD" || m == "OPTIONS") && len(tried) < len(p.Upstreams) {
+				p.forward(r, rawQuery, tried)
+				return
+			}
+			if err == ErrTimeout {
+				r.Text(504, "upstream timed out").Flush()
+			} else {
+				r.Text(502, "bad gateway").Flush()
+			}
+			return
+		}
+		resp = res
+		hdr := res.Header.Clone()
+		if res.StatusCode == 101 {
+			if err := r.Tunnel(101, hdr, func(b []byte) {
+				if b == nil {
+					res.Close()
+					finish(false)
+				} else {
+					res.Write(b)
+				}
+			}); err != nil {
+				res.Close()
+				finish(true)
+				r.Text(502, err.Error()).Flush()
+			}
+			return
+		}
+		badStatus = res.StatusCode == 502 || res.StatusCode == 503 || res.StatusCode == 504
+		size := int64(-1)
+		if _, chunked := hdr["Transfer-Encoding"]; !chunked {
+			if n, err := strconv.ParseInt(hdr.Get("Content-Length"), 10, 64); err == nil {
+				size = n
+			}
+		}
+		if size < 0 && (r.Method() == "HEAD" || res.StatusCode == 204 || res.StatusCode == 304) {
+			size = 0 // no body to chunk
+		}
+		removeHopHeaders(hdr)
+		r.StartStream(res.StatusCode, hdr.Get("Content-Type"), hdr, size)
+	})
+}
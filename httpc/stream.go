@@ -0,0 +1,123 @@
+//go:build darwin || netbsd || freebsd || openbsd || dragonfly || linux
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package httpc
+
+import (
+	"net"
+)
+
+// readStream passes the body read so far to Request.Stream.
+func (cl *Client) readStream(c *conn) {
+	if !c.streaming {
+		c.streaming = true
+		c.resp.cl, c.resp.c = cl, c
+		cl.finish(c.task, c.resp, nil)
+		c.in = append(c.in[:0], c.in[c.hdrLen:]...)
+		c.hdrLen, c.chunkOff = 0, 0
+	}
+
+	var end int
+	switch c.bodyLen {
+	case -2:
+		if len(c.in) > 0 {
+			cl.stream(c, append([]byte{}, c.in...), nil)
+			c.in = c.in[:0]
+		}
+		return
+	case -1:
+		var ok bool
+		var err error
+		if end, ok, err = c.readChunked(); err != nil {
+			cl.closeConn(c, err)
+			return
+		}
+		if len(c.body) > 0 {
+			cl.stream(c, c.body, nil)
+			c.body = nil
+		}
+		if !ok {
+			c.in = append(c.in[:0], c.in[c.chunkOff:]...)
+			c.chunkOff = 0
+			return
+		}
+	default:
+		end = len(c.in)
+		if end > c.bodyLen {
+			end = c.bodyLen
+		}
+		if end > 0 {
+			cl.stream(c, append([]byte{}, c.in[:end]...), nil)
+			c.bodyLen -= end
+		}
+		if c.bodyLen > 0 {
+			c.in = c.in[:0]
+			return
+		}
+	}
+	if end < len(c.in) {
+		c.closeAfter = true
+	}
+	cl.stream(c, nil, nil)
+	cl.release(c)
+}
+
+// stream queues a call of Request.Stream, the connection is paused if it returns false.
+func (cl *Client) stream(c *conn, p []byte, err error) {
+	f, resp := c.task.req.Stream, c.resp
+	cl.calls = append(cl.calls, func() {
+		if !f(p, err) && p != nil {
+			resp.setPaused(true)
+		}
+	})
+}
+
+func (resp *Response) setPaused(v bool) {
+	if resp.cl == nil {
+		return
+	}
+	cl := resp.cl
+	cl.mu.Lock()
+	if c := resp.c; c.resp == resp && !c.closed && c.paused != v {
+		c.paused = v
+		cl.poll.Trigger(c.fd) // events are updated in the loop
+	}
+	cl.unlock()
+}
+
+// Resume resumes reading the streaming response paused by Request.Stream.
+func (resp *Response) Resume() {
+	resp.setPaused(false)
+}
+
+// Write sends p to the server after 101 Switching Protocols.
+func (resp *Response) Write(p []byte) (int, error) {
+	if resp.cl == nil || resp.StatusCode != 101 {
+		return 0, net.ErrClosed
+	}
+	cl := resp.cl
+	cl.mu.Lock()
+	defer cl.unlock()
+	c := resp.c
+	if c.resp != resp || c.closed {
+		return 0, net.ErrClosed
+	}
+	c.out = append(c.out, p...)
+	cl.poll.Trigger(c.fd)
+	return len(p), nil
+}
+
+// Close aborts the streaming response, Request.Stream will not be called again.
+func (resp *Response) Close() {
+	if resp.cl == nil {
+		return
+	}
+	cl := resp.cl
+	cl.mu.Lock()
+	if c := resp.c; c.resp == resp && !c.closed {
+		c.task.conn = nil
+		c.task, c.streaming = nil, false
+		cl.closeConn(c, nil)
+	}
+	cl.unlock()
+}
@@ -114,10 +114,36 @@ func (p *Poll) AddReadWrite(fd int) {
 
 // ModRead ...
 func (p *Poll) ModRead(fd int) {
-	p.AddRead(fd)
+	p.mod(fd, true, false)
 }
 
 // ModReadWrite ...
 func (p *Poll) ModReadWrite(fd int) {
-	p.AddReadWrite(fd)
+	p.mod(fd, true, true)
+}
+
+// ModWrite ...
+func (p *Poll) ModWrite(fd int) {
+	p.mod(fd, false, true)
+}
+
+// ModNone stops reading and writing events of fd.
+func (p *Poll) ModNone(fd int) {
+	p.mod(fd, false, false)
+}
+
+// mod enables or disables both filters of fd like EPOLL_CTL_MOD, filters are
+// disabled rather than deleted so missing ones are not errors.
+func (p *Poll) mod(fd int, read, write bool) {
+	var evs [2]syscall.Kevent_t
+	syscall.SetKevent(&evs[0], fd, syscall.EVFILT_READ, keventFlags(read))
+	syscall.SetKevent(&evs[1], fd, syscall.EVFILT_WRITE, keventFlags(write))
+	p.changes = append(p.changes, evs[:]...)
+}
+
+func keventFlags(enable bool) int {
+	if enable {
+		return syscall.EV_ADD | syscall.EV_ENABLE
+	}
+	return syscall.EV_ADD | syscall.EV_DISABLE
 }
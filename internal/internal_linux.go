@@ -127,3 +127,23 @@ func (p *Poll) ModReadWrite(fd int) {
 		panic(err)
 	}
 }
+
+// ModWrite ...
+func (p *Poll) ModWrite(fd int) {
+	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+		&syscall.EpollEvent{Fd: int32(fd),
+			Events: syscall.EPOLLOUT,
+		},
+	); err != nil {
+		panic(err)
+	}
+}
+
+// ModNone stops reading and writing events of fd, errors are still reported with no flags.
+func (p *Poll) ModNone(fd int) {
+	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+		&syscall.EpollEvent{Fd: int32(fd)},
+	); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,132 @@
+package resh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// outWriter appends to Conn.out directly, lock must be held.
+type outWriter Conn
+
+func (w *outWriter) Write(p []byte) (int, error) {
+	w.out = append(w.out, p...)
+	return len(p), nil
+}
+
+// JSON responds with v encoded as JSON. The value is encoded into the output buffer
+// directly unless the response needs to be compressed, hashed for ETag or framed
+// by HTTP/2, or has no body. MarshalJSON methods must not write to the connection.
+func (r *HTTP) JSON(code int, v any) *HTTP {
+	const ct = "application/json; charset=utf-8"
+	if r.Conn.ln.Compression != nil || r.Conn.ln.AutoETag || r.h2 != nil || r.Method() == "HEAD" || !bodyAllowed(code) {
+		buf := compressBufPool.Get().(*bytes.Buffer)
+		defer compressBufPool.Put(buf)
+		buf.Reset()
+		if err := json.NewEncoder(buf).Encode(v); err != nil {
+			return r.Text(500, err.Error())
+		}
+		return r.respFull(code, ct, nil, btos(buf.Bytes()))
+	}
+
+	c := r.Conn
+	c.spinLock()
+	start := c.flushed + int64(len(c.out)) // absolute, the loop may flush meanwhile
+	c.spinUnlock()
+
+	r.resp0(code, ct, nil)
+	r.connHeader()
+
+	// Reserve the longest Content-Length, then move the body backward once its size is known.
+	const maxDigits = 10
+	c.spinLock()
+	c.out = append(c.out, "\r\nContent-Length: "...)
+	lenStart := len(c.out)
+	c.out = append(c.out, make([]byte, maxDigits+4)...)
+	bodyStart := len(c.out)
+	err := json.NewEncoder((*outWriter)(c)).Encode(v)
+	sent := false
+	if err == nil {
+		hdrEnd := len(strconv.AppendInt(c.out[:lenStart], int64(len(c.out)-bodyStart), 10))
+		hdrEnd += copy(c.out[hdrEnd:], "\r\n\r\n")
+		c.out = c.out[:hdrEnd+copy(c.out[hdrEnd:], c.out[bodyStart:])]
+	} else if i := start - c.flushed; i >= 0 {
+		c.out = c.out[:i]
+	} else {
+		c.out = c.out[:lenStart-len("\r\nContent-Length: ")]
+		sent = true
+	}
+	c.spinUnlock()
+
+	switch {
+	case err == nil:
+		r.done()
+	case sent:
+		r.Abort() // part of the headers has been written
+	default:
+		r.Text(500, err.Error())
+	}
+	return r
+}
+
+// BindJSON decodes the JSON body into v. If the content type is not JSON or the
+// body is invalid, a 415 or 400 response will be written and flushed, callers
+// should simply return in this case.
+func (r *HTTP) BindJSON(v any) error {
+	ct, _, _ := strings.Cut(r.GetHeader("content-type"), ";")
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	if ct != "application/json" && !(strings.HasPrefix(ct, "application/") && strings.HasSuffix(ct, "+json")) {
+		err := fmt.Errorf("unsupported content type %q", ct)
+		r.Text(415, err.Error()).Flush()
+		return err
+	}
+	if err := json.Unmarshal(r.Body(), v); err != nil {
+		r.Text(400, "invalid JSON: "+err.Error()).Flush()
+		return err
+	}
+	return nil
+}
+
+// WriteJSON sends v as a text message.
+func (ws *Websocket) WriteJSON(v any) error {
+	c := ws.Conn
+	if c.closed.Load() == 1 {
+		return net.ErrClosed
+	}
+
+	// Reserve the longest frame header, then move the payload backward once its size is known.
+	const maxHdr = 10
+	c.spinLock()
+	start := len(c.out)
+	c.out = append(c.out, make([]byte, maxHdr)...)
+	if err := json.NewEncoder((*outWriter)(c)).Encode(v); err != nil {
+		c.out = c.out[:start]
+		c.spinUnlock()
+		return err
+	}
+	payload := c.out[start+maxHdr : len(c.out)-1] // trailing newline
+	hdr := wsFrameHeader(make([]byte, 0, maxHdr), 1, len(payload))
+	copy(c.out[start+len(hdr):], payload)
+	copy(c.out[start:], hdr)
+	c.out = c.out[:start+len(hdr)+len(payload)]
+	c.spinUnlock()
+
+	c.Flush()
+	return nil
+}
+
+func wsFrameHeader(tmp []byte, typ byte, n int) []byte {
+	tmp = append(tmp, 0x80|typ)
+	if n < 126 {
+		tmp = append(tmp, byte(n))
+	} else if n < 65536 {
+		tmp = append(tmp, 126, byte(n>>8), byte(n))
+	} else {
+		tmp = binary.BigEndian.AppendUint64(append(tmp, 127), uint64(n))
+	}
+	return tmp
+}
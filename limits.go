@@ -0,0 +1,69 @@
+package resh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sizeError is returned by parsers when a RESP command or a WebSocket message exceeds its limit.
+type sizeError struct {
+	what   string
+	n, max int
+}
+
+func (e *sizeError) Error() string {
+	return fmt.Sprintf("%s too large: %db > %db", e.what, e.n, e.max)
+}
+
+func (ln *Listener) redisMaxBytes() int {
+	if ln.RedisMaxBytes > 0 {
+		return ln.RedisMaxBytes
+	}
+	return RequestMaxBytes
+}
+
+// redisCommandMaxBytes returns the limit of the command name, or def if it has none.
+func (ln *Listener) redisCommandMaxBytes(name []byte, def int) int {
+	if v := ln.RedisCommandMaxBytes[strings.ToUpper(btos(name))]; v > 0 {
+		return v
+	}
+	return def
+}
+
+func (ln *Listener) wsMaxBytes() int {
+	if ln.WSMaxMessageBytes > 0 {
+		return ln.WSMaxMessageBytes
+	}
+	return RequestMaxBytes
+}
+
+// maxBodyBytes returns the body limit of the request, the most specific one wins.
+func (ln *Listener) maxBodyBytes(r *HTTP) int {
+	if ln.HTTPRouteMaxBodyBytes != nil {
+		if v := ln.HTTPRouteMaxBodyBytes(r); v > 0 {
+			return v
+		}
+	}
+	if ln.vhosts != nil {
+		if v := ln.vhosts.Lookup(r.Host); v != nil && v.MaxBodyBytes > 0 {
+			return v.MaxBodyBytes
+		}
+	}
+	if ln.HTTPMaxBodyBytes > 0 {
+		return ln.HTTPMaxBodyBytes
+	}
+	return RequestMaxBytes
+}
+
+// tooLarge rejects the oversized RESP command or WebSocket message and closes the connection.
+func (ln *Listener) tooLarge(c *Conn, e *sizeError) {
+	ln.OnError(Error{Type: "oversize", Cause: e})
+	if c.ws != nil {
+		c.ws.closed = true
+		c._writeString(string(wsFrameHeader(nil, 8, 2+15)) + "\x03\xf1message too big") // 1009
+	} else {
+		c._writeString("-ERR " + e.Error() + "\r\n")
+	}
+	c.closeAfterFlush()
+	ln.writeConn(c)
+}
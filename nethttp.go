@@ -0,0 +1,334 @@
+package resh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// netHTTPBufferBytes is the size of response buffered before deciding whether
+// to send it with Content-Length or chunked encoding.
+const netHTTPBufferBytes = 4096
+
+// HTTPHandler adapts h to an OnHTTP handler, see ServeHandler.
+func HTTPHandler(h http.Handler) func(*HTTP) bool {
+	return func(r *HTTP) bool {
+		r.ServeHandler(h)
+		return true
+	}
+}
+
+// ServeHandler serves the request with h in a new goroutine. The response is
+// streamed back to the client at its pace, http.Flusher and http.Hijacker are
+// supported. If h panics, the stream is reset on HTTP/2 and the connection is
+// closed on HTTP/1, panics other than http.ErrAbortHandler are reported to
+// Listener.OnError.
+func (sh *HTTP) ServeHandler(h http.Handler) {
+	r, cancel := sh.netHTTPRequest()
+	go func() {
+		defer cancel()
+		w := &netHTTPResponseWriter{sh: sh, async: true}
+		defer func() {
+			p := recover()
+			if p == nil {
+				w.finish()
+				return
+			}
+			if p != http.ErrAbortHandler {
+				sh.Conn.ln.OnError(Error{Type: "panic", Cause: fmt.Errorf("handler panic %v: %s", p, debug.Stack())})
+			}
+			if w.hijacked {
+				sh.Conn.Close()
+			} else {
+				sh.Abort()
+			}
+		}()
+		h.ServeHTTP(w, r)
+	}()
+}
+
+// RunGoHandler serves the request with h synchronously, the response is
+// buffered in memory and can't be hijacked.
+func (sh *HTTP) RunGoHandler(h http.HandlerFunc) {
+	r, cancel := sh.netHTTPRequest()
+	defer cancel()
+	w := &netHTTPResponseWriter{sh: sh}
+	h(w, r)
+	w.finish()
+}
+
+func (sh *HTTP) netHTTPRequest() (*http.Request, context.CancelFunc) {
+	r := &http.Request{}
+	r.URL = sh.URL()
+	r.RequestURI = r.URL.RequestURI()
+	r.Method = sh.Method()
+	r.Proto = sh.Proto()
+	r.ProtoMajor, r.ProtoMinor = 1, int(sh.minor)
+	if sh.h2 != nil {
+		r.ProtoMajor, r.ProtoMinor = 2, 0
+	}
+	r.Close = sh.closeConn
+	r.Host = sh.Host
+	r.Header = make(http.Header)
+	r.RemoteAddr = sh.Conn.RemoteAddr().String()
+	if sh.Conn.ssl != nil {
+		r.TLS = &tls.ConnectionState{
+			HandshakeComplete:  true,
+			ServerName:         sh.Host,
+			NegotiatedProtocol: "http/1.1",
+		}
+		if sh.h2 != nil {
+			r.TLS.NegotiatedProtocol = "h2"
+		}
+	}
+
+	sh.ForeachHeader(func(sk string, v string) bool {
+		switch sk {
+		case "transfer-encoding":
+			r.TransferEncoding = append(r.TransferEncoding, v)
+		default:
+			r.Header.Add(sk, v)
+		}
+		return true
+	})
+
+	if body := sh.Body(); len(body) > 0 {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	} else {
+		r.Body = http.NoBody
+	}
+
+	ctx, cancel := context.WithCancel(sh.Conn.closeContext())
+	return r.WithContext(ctx), cancel
+}
+
+type netHTTPResponseWriter struct {
+	sh       *HTTP
+	async    bool // can wait for the output to drain
+	code     int
+	h        http.Header
+	buf      []byte
+	started  bool // headers have been written
+	length   int64
+	written  int64
+	hijacked bool
+}
+
+func (w *netHTTPResponseWriter) StatusCode() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+func (w *netHTTPResponseWriter) Header() http.Header {
+	if w.h == nil {
+		w.h = make(http.Header)
+	}
+	return w.h
+}
+
+func (w *netHTTPResponseWriter) WriteHeader(statusCode int) {
+	if w.code == 0 {
+		w.code = statusCode
+	}
+}
+
+func (w *netHTTPResponseWriter) contentType(p []byte) string {
+	if ct := w.h.Get("Content-Type"); ct != "" || w.h != nil && w.h["Content-Type"] != nil {
+		return ct
+	}
+	return http.DetectContentType(p)
+}
+
+// contentLength returns the Content-Length set by the handler, or -1.
+func (w *netHTTPResponseWriter) contentLength() int64 {
+	if w.started {
+		return w.length
+	}
+	if cl, err := strconv.ParseInt(w.h.Get("Content-Length"), 10, 64); err == nil && cl >= 0 {
+		return cl
+	}
+	return -1
+}
+
+func (w *netHTTPResponseWriter) start() {
+	w.length = w.contentLength()
+	w.started = true
+	if cl := w.length; cl >= 0 {
+		w.sh.respHeaders(w.StatusCode(), w.contentType(w.buf), w.h, cl)
+		w.sh.writeBody(btos(w.buf))
+	} else {
+		w.sh.StartChunked(w.StatusCode(), w.contentType(w.buf), w.h)
+		w.sh.Write(w.buf)
+	}
+	w.buf = nil
+}
+
+func (w *netHTTPResponseWriter) Write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if cl := w.contentLength(); cl >= 0 && w.written+int64(len(p)) > cl {
+		return 0, http.ErrContentLength
+	}
+	w.written += int64(len(p))
+	if !w.started {
+		if len(w.buf)+len(p) <= netHTTPBufferBytes || !w.async {
+			w.buf = append(w.buf, p...)
+			return len(p), nil
+		}
+		w.start()
+	}
+	if w.length >= 0 {
+		if w.sh.Conn.closed.Load() == 1 {
+			return 0, net.ErrClosed
+		}
+		w.sh.writeBody(btos(p))
+	} else {
+		w.sh.Write(p)
+	}
+	if w.async && !w.sh.waitDrain() {
+		return 0, net.ErrClosed
+	}
+	return len(p), nil
+}
+
+func (w *netHTTPResponseWriter) Flush() {
+	if w.hijacked || !w.async {
+		return
+	}
+	if !w.started {
+		w.start()
+	}
+	if w.sh.chunked && len(w.sh.chkbuf) > 0 {
+		w.sh.writeChunked(w.sh.chkbuf)
+		w.sh.chkbuf = w.sh.chkbuf[:0]
+	}
+	if w.sh.zw != nil {
+		if f, ok := w.sh.zw.(interface{ Flush() error }); ok {
+			f.Flush()
+		}
+	}
+	w.sh.Flush()
+}
+
+func (w *netHTTPResponseWriter) finish() {
+	if w.hijacked {
+		return
+	}
+	if !w.started {
+		w.sh.BytesHeaders(w.StatusCode(), w.contentType(w.buf), w.h, w.buf).Flush()
+	} else if w.length >= 0 {
+		if w.written < w.length && !w.sh.noBody {
+			// The client would wait for the rest of the body.
+			w.sh.Abort()
+			return
+		}
+		w.sh.done()
+		w.sh.Flush()
+	} else {
+		w.sh.FinishChunked()
+	}
+}
+
+func (w *netHTTPResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !w.async {
+		return nil, nil, fmt.Errorf("hijacking requires ServeHandler")
+	}
+	if w.sh.h2 != nil {
+		return nil, nil, fmt.Errorf("hijacking is not supported by HTTP/2")
+	}
+	if w.started || w.hijacked {
+		return nil, nil, fmt.Errorf("response already written")
+	}
+	w.hijacked = true
+	hc := &hijackedConn{c: w.sh.Conn}
+	hc.cond.L = &hc.mu
+	hc.c.OnClose(func() { hc.feed(nil) })
+
+	c := w.sh.Conn
+	c.spinLock()
+	hc.in = append(hc.in, c.in...)
+	c.in = nil
+	c.raw = hc.feed
+	c.async.CompareAndSwap(w.sh, nil)
+	c.resume.Store(false)
+	c.spinUnlock()
+	c.Flush() // reading may have been stopped for the response
+	return hc, bufio.NewReadWriter(bufio.NewReader(hc), bufio.NewWriter(hc)), nil
+}
+
+// hijackedConn is a net.Conn over a Conn in raw mode.
+type hijackedConn struct {
+	c      *Conn
+	mu     sync.Mutex
+	cond   sync.Cond
+	in     []byte
+	closed bool
+}
+
+// feed is called by the loop, p == nil means EOF.
+func (hc *hijackedConn) feed(p []byte) {
+	hc.mu.Lock()
+	if p == nil {
+		hc.closed = true
+	} else {
+		hc.in = append(hc.in, p...)
+	}
+	hc.mu.Unlock()
+	hc.cond.Broadcast()
+}
+
+func (hc *hijackedConn) Read(p []byte) (int, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for len(hc.in) == 0 {
+		if hc.closed {
+			return 0, io.EOF
+		}
+		hc.cond.Wait()
+	}
+	n := copy(p, hc.in)
+	hc.in = hc.in[:copy(hc.in, hc.in[n:])]
+	return n, nil
+}
+
+func (hc *hijackedConn) Write(p []byte) (int, error) {
+	n, err := hc.c.Write(p)
+	if err != nil {
+		return n, err
+	}
+	hc.c.Flush()
+	if !hc.c.waitDrain(StreamDrainBytes) {
+		return n, net.ErrClosed
+	}
+	return n, nil
+}
+
+func (hc *hijackedConn) Close() error {
+	hc.c.closeAfterFlush()
+	hc.c.Flush()
+	return nil
+}
+
+func (hc *hijackedConn) LocalAddr() net.Addr { return hc.c.ln.Addr() }
+
+func (hc *hijackedConn) RemoteAddr() net.Addr { return hc.c.RemoteAddr() }
+
+// Deadlines are not supported, use Listener.Timeout instead.
+func (hc *hijackedConn) SetDeadline(t time.Time) error { return nil }
+
+func (hc *hijackedConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (hc *hijackedConn) SetWriteDeadline(t time.Time) error { return nil }
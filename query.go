@@ -0,0 +1,207 @@
+package resh
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/coyove/sdss/contrib/plru"
+)
+
+// ForeachQuery iterates query parameters in order, including repeated keys.
+// The query is unescaped into a copy on the first call, RawQuery is kept intact.
+func (r *HTTP) ForeachQuery(f func(k string, v string)) {
+	if r.query == nil {
+		r.query = [][2]string{}
+		if r.qStart > 0 {
+			for query := append([]byte{}, r.data[r.qStart:r.qEnd]...); len(query) > 0; {
+				var part []byte
+				part, query, _ = bytes.Cut(query, []byte("&"))
+				if len(part) == 0 {
+					continue
+				}
+				key, value, _ := bytes.Cut(part, []byte("="))
+				r.query = append(r.query, [2]string{btos(UnescapeInplace(key, true)), btos(UnescapeInplace(value, true))})
+			}
+		}
+	}
+	for _, kv := range r.query {
+		f(kv[0], kv[1])
+	}
+}
+
+// Query returns the first value of each query parameter, the map is empty if there is no query.
+func (r *HTTP) Query() *plru.Map[string, string] {
+	if r.qmap == nil {
+		r.qmap = plru.NewMap[string, string](4, plru.Hash.Str)
+		r.ForeachQuery(func(k string, v string) {
+			if !r.qmap.Contains(k) {
+				r.qmap.Set(k, v)
+			}
+		})
+	}
+	return r.qmap
+}
+
+// QueryValues returns all values of the query parameter.
+func (r *HTTP) QueryValues(k string) (res []string) {
+	r.ForeachQuery(func(qk, qv string) {
+		if qk == k {
+			res = append(res, qv)
+		}
+	})
+	return
+}
+
+// URLQuery returns a copy of the query parameters.
+func (r *HTTP) URLQuery() url.Values {
+	q := url.Values{}
+	r.ForeachQuery(func(k, v string) { q[k] = append(q[k], v) })
+	return q
+}
+
+// GetQuery returns the first value of the query parameter, or "" if not found.
+func (r *HTTP) GetQuery(k string) string {
+	return r.Query().Get(k)
+}
+
+func (r *HTTP) GetQueryInt64(k string) (int64, error) {
+	return strconv.ParseInt(r.GetQuery(k), 10, 64)
+}
+
+func (r *HTTP) GetQueryBool(k string) (bool, error) {
+	return strconv.ParseBool(r.GetQuery(k))
+}
+
+func (r *HTTP) GetQueryFloat64(k string) (float64, error) {
+	return strconv.ParseFloat(r.GetQuery(k), 64)
+}
+
+// GetQueryDuration parses the query parameter like "1.5s" or "300ms".
+func (r *HTTP) GetQueryDuration(k string) (time.Duration, error) {
+	return time.ParseDuration(r.GetQuery(k))
+}
+
+func (r *HTTP) GetQueryTime(k, layout string) (time.Time, error) {
+	return time.Parse(layout, r.GetQuery(k))
+}
+
+func (r *HTTP) GetQueryInt64Default(k string, v int64) int64 {
+	if res, err := r.GetQueryInt64(k); err == nil {
+		return res
+	}
+	return v
+}
+
+func (r *HTTP) GetQueryBoolDefault(k string, v bool) bool {
+	if res, err := r.GetQueryBool(k); err == nil {
+		return res
+	}
+	return v
+}
+
+func (r *HTTP) GetQueryFloat64Default(k string, v float64) float64 {
+	if res, err := r.GetQueryFloat64(k); err == nil {
+		return res
+	}
+	return v
+}
+
+func (r *HTTP) GetQueryDurationDefault(k string, v time.Duration) time.Duration {
+	if res, err := r.GetQueryDuration(k); err == nil {
+		return res
+	}
+	return v
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// BindQuery fills fields of the struct pointed by dst from the query by their
+// `query:"name"` tags. Supported types are strings, bools, integers, floats,
+// time.Duration, time.Time (RFC3339) and slices of them, which take all values.
+// Fields of missing or invalid parameters are left untouched.
+func (r *HTTP) BindQuery(dst any) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("BindQuery: %T is not a pointer to struct", dst)
+	}
+	rv = rv.Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		f := rv.Type().Field(i)
+		name := f.Tag.Get("query")
+		if name == "" || name == "-" || !f.IsExported() {
+			continue
+		}
+		values := r.QueryValues(name)
+		if len(values) == 0 {
+			continue
+		}
+		fv := rv.Field(i)
+		if fv.Kind() != reflect.Slice {
+			if err := setQueryValue(fv, values[0]); err != nil {
+				return fmt.Errorf("query %s: %v", name, err)
+			}
+			continue
+		}
+		tmp := reflect.MakeSlice(fv.Type(), len(values), len(values))
+		for j, v := range values {
+			if err := setQueryValue(tmp.Index(j), v); err != nil {
+				return fmt.Errorf("query %s: %v", name, err)
+			}
+		}
+		fv.Set(tmp)
+	}
+	return nil
+}
+
+// setQueryValue sets v only if s is valid.
+func setQueryValue(v reflect.Value, s string) error {
+	switch v.Type() {
+	case durationType:
+		d, err := time.ParseDuration(s)
+		if err == nil {
+			v.SetInt(int64(d))
+		}
+		return err
+	case timeType:
+		t, err := time.Parse(time.RFC3339, s)
+		if err == nil {
+			v.Set(reflect.ValueOf(t))
+		}
+		return err
+	}
+	var err error
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(s); err == nil {
+			v.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if n, err = strconv.ParseInt(s, 10, v.Type().Bits()); err == nil {
+			v.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if n, err = strconv.ParseUint(s, 10, v.Type().Bits()); err == nil {
+			v.SetUint(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		var n float64
+		if n, err = strconv.ParseFloat(s, v.Type().Bits()); err == nil {
+			v.SetFloat(n)
+		}
+	default:
+		err = fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return err
+}
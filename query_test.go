@@ -0,0 +1,34 @@
+package resh
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBindQueryInvalidKeepsDefault(t *testing.T) {
+	type query struct {
+		N int           `query:"n"`
+		D time.Duration `query:"d"`
+		T time.Time     `query:"t"`
+		S []int         `query:"s"`
+	}
+	def := query{N: 7, D: time.Second, T: time.Unix(1, 0), S: []int{1}}
+	for _, in := range []string{"n=x", "d=x", "t=x", "s=2&s=x"} {
+		ln := &Listener{}
+		c := testConn(ln)
+		var srs serverReadState
+		if err := srs.process(ln, []byte("GET /?"+in+" HTTP/1.1\r\nHost: x\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		srs.http.Conn = c
+		q := def
+		q.S = append([]int(nil), def.S...)
+		if err := srs.http.BindQuery(&q); err == nil {
+			t.Errorf("%s: no error", in)
+		}
+		if !reflect.DeepEqual(q, def) {
+			t.Errorf("%s: got %+v, want %+v", in, q, def)
+		}
+	}
+}
@@ -10,6 +10,8 @@ type Redis struct {
 	read  uint32
 	nargs uint16
 	ai    [][2]uint32 // [[start, length] ...]
+	max   int         // size limit of the command
+	log   *AccessEntry
 }
 
 func (r *Redis) Len() int {
@@ -88,10 +90,12 @@ func (r *Redis) WriteArrayBegin(n int) *Redis {
 }
 
 func (r *Redis) Flush() *Redis {
+	r.endLog(false)
 	r.Conn.Flush()
 	return r
 }
 
 func (r *Redis) Release() {
+	r.endLog(true)
 	r.Conn.ReuseInputBuffer(r.data)
 }
@@ -10,6 +10,8 @@ package resh
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
 	"runtime"
 	"runtime/debug"
@@ -25,7 +27,8 @@ import (
 var (
 	ShortWriteEmitter = func() {}
 	WriteRaceEmitter  = func(int) {}
-	RequestMaxBytes   = 1 * 1024 * 1024
+	RequestMaxBytes   = 1 * 1024 * 1024 // default size limit of RESP commands, HTTP bodies and WebSocket messages
+	StreamDrainBytes  = 256 * 1024      // streaming writers wait until the output is shorter than this
 	TCPKeepAlive      = 60
 	DebugFlag         = os.Getenv("RESH_DEBUG") != ""
 )
@@ -65,6 +68,13 @@ type Listener struct {
 	fdhead  *Conn
 	fdtail  *Conn
 	sslCtx  *SSLCtx
+	sniCtxs []*SSLCtx
+	vhosts  *VirtualHosts
+
+	trustedProxies []netip.Prefix
+
+	compressors compressorPools
+	date        atomic.Pointer[httpDate]
 
 	OnRedis   func(*Redis) (more bool)
 	OnHTTP    func(*HTTP) (more bool)
@@ -73,6 +83,78 @@ type Listener struct {
 	OnFdCount func(int)
 	OnError   func(Error)
 	Timeout   time.Duration
+
+	// OnHTTPContinue is called when a request with 'Expect: 100-continue' has
+	// its headers parsed but not its body. Return true to let the client send
+	// the body, or false to reject the upload: the response written by the
+	// callback (417 if nothing was written) is sent and the connection is closed.
+	// If nil, '100 Continue' is always sent.
+	OnHTTPContinue func(*HTTP) (accept bool)
+	// Compression enables compressed HTTP responses if not nil.
+	Compression *Compression
+	// AutoETag adds strong ETags, hashed from bodies, to 200 responses of GET and
+	// HEAD written by Bytes, Text and JSON, matching If-None-Match gets 304.
+	AutoETag bool
+	// ServerName is the value of the Server header, "resh" if empty.
+	ServerName string
+	// NoServerHeader omits the Server header from responses, unless the handler
+	// sets one, ServerName is then ignored.
+	NoServerHeader bool
+	// Limits of HTTP request headers, requests exceeding them will get 431.
+	// 0 means 100 headers and 64KB.
+	HTTPMaxHeaders     int
+	HTTPMaxHeaderBytes int
+	// Size limits of RESP commands, HTTP request bodies and WebSocket messages,
+	// 0 means RequestMaxBytes. Oversized RESP commands get an error reply, HTTP
+	// requests get 413 and WebSocket connections are closed with 1009.
+	RedisMaxBytes     int
+	HTTPMaxBodyBytes  int
+	WSMaxMessageBytes int
+	// RedisCommandMaxBytes overrides RedisMaxBytes by upper-case command names,
+	// e.g. a tiny limit for PING.
+	RedisCommandMaxBytes map[string]int
+	// HTTPRouteMaxBodyBytes returns the body limit of a request once its headers
+	// are parsed, it overrides VirtualHost.MaxBodyBytes and HTTPMaxBodyBytes
+	// unless 0 is returned.
+	HTTPRouteMaxBodyBytes func(*HTTP) int
+	// OnHTTPError customizes the response sent to malformed or oversized
+	// requests (400, 413, 414, 431 and 505) before closing the connection.
+	OnHTTPError func(code int, cause error) (contentType string, body []byte)
+	// AccessLog logs HTTP requests, RESP commands and WebSocket sessions if not nil.
+	// HTTP requests are assigned X-Request-ID if not provided by clients.
+	AccessLog *AccessLog
+	// HTTP2 enables HTTP/2 on the same port: prior knowledge h2c, 'Upgrade: h2c'
+	// and ALPN h2 over TLS. Streams are delivered to OnHTTP like HTTP/1 requests.
+	HTTP2 bool
+	// HTTP2MaxStreams limits concurrent streams per connection, 0 means 100.
+	HTTP2MaxStreams int
+	// OnHTTPBody is called once headers of a request with a body are parsed.
+	// Return a BodyStream to receive the body in pieces, OnHTTP is then called
+	// immediately with an empty Body. Return nil to buffer the body as usual.
+	OnHTTPBody func(*HTTP) *BodyStream
+	// TrustedProxies are CIDRs or IPs of reverse proxies, whose forwarding
+	// headers are believed by HTTP.ClientIP.
+	TrustedProxies []string
+	// HTTPLenientParsing disables strict HTTP/1 parsing, under which malformed
+	// or ambiguous requests that may be used to smuggle requests get 400.
+	// Transfer-Encoding is rejected even if it is set.
+	HTTPLenientParsing bool
+}
+
+type httpDate struct {
+	sec   int64
+	value string
+}
+
+// httpDate returns the current time formatted for the Date header, the string is cached for a second.
+func (ln *Listener) httpDate() string {
+	now := time.Now()
+	if d := ln.date.Load(); d != nil && d.sec == now.Unix() {
+		return d.value
+	}
+	d := &httpDate{sec: now.Unix(), value: now.UTC().Format(http.TimeFormat)}
+	ln.date.Store(d)
+	return d.value
 }
 
 func (ln *Listener) Addr() net.Addr {
@@ -112,6 +194,25 @@ func (ln *Listener) Serve() {
 	if ln.OnFdCount == nil {
 		ln.OnFdCount = func(int) {}
 	}
+	if ln.ServerName == "" {
+		ln.ServerName = "resh"
+	}
+	if ln.HTTPMaxHeaders == 0 {
+		ln.HTTPMaxHeaders = 100
+	}
+	if ln.HTTPMaxHeaderBytes == 0 {
+		ln.HTTPMaxHeaderBytes = 64 * 1024
+	}
+	ln.trustedProxies = parseTrustedProxies(ln.TrustedProxies)
+	if ln.HTTP2MaxStreams == 0 {
+		ln.HTTP2MaxStreams = 100
+	}
+	if ln.HTTP2 && ln.sslCtx != nil {
+		ln.sslCtx.enableH2()
+		for _, ctx := range ln.sniCtxs {
+			ctx.enableH2()
+		}
+	}
 
 	ln.poll = internal.OpenPoll()
 	ln.buffer = make([]byte, 0xFFFF)
@@ -134,7 +235,14 @@ func (ln *Listener) Serve() {
 
 	ln.poll.Wait(func(fd int, ev uint32) error {
 		if fd == ln.fd {
+			// Connections must not leak into child processes, their epoll
+			// registrations would outlive closing and hit reused fds.
+			syscall.ForkLock.RLock()
 			nfd, sa, err := syscall.Accept(fd)
+			if err == nil {
+				syscall.CloseOnExec(nfd)
+			}
+			syscall.ForkLock.RUnlock()
 			if err != nil {
 				if err == syscall.EAGAIN {
 					return nil
@@ -179,11 +287,25 @@ func (ln *Listener) Serve() {
 			ln.attachConn(c.detach())
 
 			if ev&internal.WRITE > 0 {
+				c.spinLock()
+				tasks := c.tasks
+				c.tasks = nil
+				c.spinUnlock()
+				for _, f := range tasks {
+					f()
+				}
 				ln.writeConn(c)
+				if c.async.Load() == nil && c.resume.CompareAndSwap(true, false) {
+					ln.parseConn(c, 0)
+				}
 			}
 			if ev&internal.READ > 0 {
 				ln.readConn(c)
 			}
+			if ev == 0 {
+				// Errors of connections whose reading is paused.
+				ln.closeConnWithError(c, "hangup", nil)
+			}
 			if ev&internal.EOF > 0 {
 				ln.closeConnWithError(c, "eof", nil)
 			}
@@ -220,8 +342,29 @@ func (ln *Listener) closeConnWithError(c *Conn, errType string, err error) {
 	if c.ws != nil {
 		ln.OnWSClose(c.ws, c.ws.closingData)
 	}
+	if c.srs.body != nil {
+		c.srs.body.end(errBodyAborted)
+	}
+	if c.h2 != nil {
+		c.h2.abortBodies()
+	}
 
 	ln.OnFdCount(int(atomic.AddInt32(&ln.count, -1)))
+	c.spinLock()
+	c.notifyDrain()
+	onClose := c.onClose
+	c.onClose = nil
+	logs := c.logs
+	c.logs = nil
+	if c.ws != nil && c.ws.log != nil {
+		c.ws.log.BytesOut = int(c.flushed + int64(len(c.out)) - c.ws.log.out0)
+		logs = append(logs, c.ws.log)
+	}
+	c.spinUnlock()
+	if len(logs) > 0 {
+		// Some responses can't be flushed, their latencies are until now.
+		ln.emitLogs(logs)
+	}
 	c.detach()
 	delete(ln.fdconns, c.fd)
 
@@ -243,13 +386,21 @@ func (ln *Listener) closeConnWithError(c *Conn, errType string, err error) {
 	if c.ssl != nil {
 		c.ssl.Close()
 	}
+	for _, f := range onClose {
+		(*f)()
+	}
 }
 
 func (ln *Listener) writeConn(c *Conn) int {
 	c.spinLock()
 	if len(c.out) == 0 {
+		closing := c.closing
 		c.spinUnlock()
-		ln.poll.ModRead(c.fd)
+		if closing {
+			ln.closeConnWithError(c, "", nil)
+		} else {
+			ln.modRead(c)
+		}
 		return 1
 	}
 
@@ -260,13 +411,19 @@ func (ln *Listener) writeConn(c *Conn) int {
 	} else {
 		n, err = syscall.Write(c.fd, c.out)
 	}
+	if n > 0 {
+		if logs := c.flushedLogs(n); logs != nil {
+			defer ln.emitLogs(logs)
+		}
+	}
 	if err != nil {
 		if err == syscall.EAGAIN {
 			if n > 0 {
 				c.out = c.out[n:]
+				c.notifyDrain()
 			}
 			c.spinUnlock()
-			ln.poll.ModReadWrite(c.fd)
+			ln.modReadWrite(c)
 			return -n
 		}
 		c.spinUnlock()
@@ -276,20 +433,23 @@ func (ln *Listener) writeConn(c *Conn) int {
 
 	if n == len(c.out) {
 		c.out = c.out[:0]
+		c.notifyDrain()
+		closing := c.closing
 		c.spinUnlock()
 
-		if c.ws != nil && c.ws.closed {
+		if closing || (c.ws != nil && c.ws.closed) {
 			ln.closeConnWithError(c, "", nil)
 		} else {
-			ln.poll.ModRead(c.fd)
+			ln.modRead(c)
 		}
 		return 1
 	}
 
 	c.out = c.out[n:]
+	c.notifyDrain()
 	c.spinUnlock()
 
-	ln.poll.ModReadWrite(c.fd)
+	ln.modReadWrite(c)
 	ShortWriteEmitter()
 	return -n
 }
@@ -308,36 +468,109 @@ func (ln *Listener) readConn(c *Conn) {
 	}
 	if err != nil {
 		if err == syscall.EAGAIN {
-			ln.poll.ModRead(c.fd)
+			ln.modRead(c)
 			return
 		}
 		ln.closeConnWithError(c, "read", err)
 		return
 	}
+	ln.parseConn(c, n)
+}
 
+// parseConn parses inputs of c, the last n bytes read are in ln.buffer.
+func (ln *Listener) parseConn(c *Conn, n int) {
+	var err error
 PARSE_NEXT:
 	c.spinLock()
+	if c.raw != nil {
+		raw := c.raw
+		c.spinUnlock()
+		raw(ln.buffer[:n])
+		return
+	}
+	if c.closing {
+		// The connection is going to be closed, inputs are meaningless.
+		c.spinUnlock()
+		return
+	}
 	c.in = append(c.in, ln.buffer[:n]...)
-	if len(c.in) > RequestMaxBytes {
-		ln.closeConnWithError(c, "oversize", fmt.Errorf("request too large: %db", len(c.in)))
+	if c.h2 != nil {
+		in := c.in
+		c.spinUnlock()
+		ln.readH2(c, in)
 		return
 	}
+	if c.srs.stage == 10 {
+		c.spinUnlock()
+		if !ln.readBody(c) {
+			return
+		}
+		c.srs = serverReadState{}
+		n = 0
+		goto PARSE_NEXT
+	}
 	if c.ws != nil {
 		if c.ws.closed {
 			err = errWaitMore
 		} else {
 			err = c.ws.parse(c.in)
 		}
+	} else if c.async.Load() != nil {
+		// The response is written by another goroutine, following requests
+		// are parsed once it is done, reading is stopped meanwhile.
+		c.resume.Store(len(c.in) > 0)
+		writing := len(c.out) > 0
+		c.spinUnlock()
+		if writing {
+			ln.modReadWrite(c)
+		} else {
+			ln.modRead(c)
+		}
+		return
 	} else {
-		err = c.srs.process(c.in)
+		err = c.srs.process(ln, c.in)
 	}
 	c.spinUnlock()
 
+	if err == errH2Preface {
+		c.h2 = newH2Conn(c)
+		c.srs = serverReadState{}
+		n = 0
+		goto PARSE_NEXT
+	}
+
+	if err == errHTTPBody {
+		req := c.srs.http
+		req.Conn = c
+		if bs := ln.OnHTTPBody(req); bs != nil {
+			if !ln.startBody(c, req, bs) {
+				return
+			}
+		} else if max := ln.maxBodyBytes(req); int(req.bodyLen) > max {
+			ln.httpError(c, &httpError{413, fmt.Errorf("request body too large: %db > %db", req.bodyLen, max)})
+			return
+		}
+		n = 0
+		goto PARSE_NEXT
+	}
+
 	if err == errWaitMore {
+		if req := c.srs.http; req != nil && req.expect100 && c.srs.stage == 7 {
+			req.expect100 = false
+			ln.expectContinue(c, req)
+		}
 		return
 	}
 
 	if err != nil {
+		if e, ok := err.(*sizeError); ok {
+			ln.tooLarge(c, e)
+			return
+		}
+		if e, ok := err.(*httpError); ok && c.srs.http != nil {
+			ln.httpError(c, e)
+			return
+		}
 		ln.closeConnWithError(c, "read", err)
 		return
 	}
@@ -345,6 +578,9 @@ PARSE_NEXT:
 	if c.ws != nil {
 		req := c.ws.parsedFrame
 		remain := c.truncateInputBuffer(req.len)
+		if c.ws.log != nil {
+			c.ws.log.BytesIn += req.len
+		}
 		if !ln.onWebsocket(req, c) {
 			// Conn already closed
 			return
@@ -356,19 +592,33 @@ PARSE_NEXT:
 	} else if c.srs.http != nil {
 		req := c.srs.http
 		req.Conn = c
-		c.truncateInputBuffer(int(req.bodyLen) + int(req.hdrLen))
+		remain := c.truncateInputBuffer(int(req.bodyLen) + int(req.hdrLen))
+		upgrade := req.h2c && ln.HTTP2 && c.ssl == nil && ln.upgradeH2C(c, req)
+		if !upgrade {
+			c.async.Store(req)
+		}
+		ln.logHTTP(req)
 		if !ln.OnHTTP(req) {
 			ln.closeConnWithError(c, "", nil)
 			return
 		}
+		if remain > 0 {
+			// Pipelined requests, or the client preface following the upgrade
+			// request. They wait if the response is written asynchronously.
+			c.srs = serverReadState{}
+			n = 0
+			goto PARSE_NEXT
+		}
 	} else {
 		req := c.srs.redis
 		req.Conn = c
 		c.truncateInputBuffer(int(req.read))
+		ln.logRedis(req)
 		if !ln.OnRedis(req) {
 			ln.closeConnWithError(c, "", nil)
 			return
 		}
+		req.endLog(false)
 	}
 	c.srs = serverReadState{}
 
@@ -377,6 +627,43 @@ PARSE_NEXT:
 	}
 }
 
+// httpError responds with the error and closes the connection afterwards.
+func (ln *Listener) httpError(c *Conn, e *httpError) {
+	ln.OnError(Error{Type: "http", Cause: e})
+	contentType, body := "", []byte(http.StatusText(e.code))
+	if ln.OnHTTPError != nil {
+		contentType, body = ln.OnHTTPError(e.code, e.cause)
+	}
+	req := &HTTP{Conn: c, closeConn: true}
+	if ln.AccessLog != nil {
+		req.log = ln.newAccessEntry(c, "HTTP/1.1", len(c.in))
+		req.log.Method = "-"
+	}
+	req.Bytes(e.code, contentType, body)
+	ln.writeConn(c)
+}
+
+func (ln *Listener) expectContinue(c *Conn, req *HTTP) {
+	req.Conn = c
+	accept := true
+	if ln.OnHTTPContinue != nil {
+		// Any response written by the callback is final.
+		closeConn := req.closeConn
+		req.closeConn = true
+		accept = ln.OnHTTPContinue(req)
+		req.closeConn = closeConn
+	}
+	if accept {
+		c._writeString("HTTP/1.1 100 Continue\r\n\r\n")
+	} else if len(c.out) == 0 {
+		req.closeConn = true
+		req.Text(417, http.StatusText(417))
+	} else {
+		c.closeAfterFlush()
+	}
+	ln.writeConn(c)
+}
+
 func (ln *Listener) Close() {
 	if ln.fd != 0 {
 		syscall.Close(ln.fd)
@@ -387,6 +674,9 @@ func (ln *Listener) Close() {
 	if ln.raw != nil {
 		ln.raw.Close()
 	}
+	for _, ctx := range ln.sniCtxs {
+		ctx.close()
+	}
 	if ln.sslCtx != nil {
 		ln.sslCtx.close()
 		runtime.UnlockOSThread()
@@ -0,0 +1,135 @@
+package resh
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var SSEHeartbeat = 15 * time.Second
+
+// EventStream is a 'text/event-stream' response started by StartSSE.
+// All methods are safe to call from any goroutine.
+type EventStream struct {
+	r      *HTTP
+	mu     sync.Mutex
+	buf    []byte
+	timer  *time.Timer
+	done   chan struct{}
+	closed bool
+	unhook func() // unregisters the close callback of the connection
+}
+
+// StartSSE starts a Server-Sent Events stream. Events are flushed immediately,
+// and comment heartbeats are sent if nothing is sent within SSEHeartbeat.
+func (r *HTTP) StartSSE() *EventStream {
+	r.acceptEnc = 0 // compressors buffer their outputs
+	r.StartChunked(200, "text/event-stream", http.Header{
+		"Cache-Control":     {"no-cache"},
+		"X-Accel-Buffering": {"no"},
+	})
+	r.Flush()
+
+	s := &EventStream{r: r, done: make(chan struct{})}
+	if SSEHeartbeat > 0 {
+		s.timer = time.AfterFunc(SSEHeartbeat, s.heartbeat)
+	}
+	s.unhook = r.Conn.addCloseHook(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stop()
+	})
+	return s
+}
+
+// LastEventID returns the Last-Event-ID header sent by a reconnecting client.
+func (s *EventStream) LastEventID() string {
+	return s.r.GetHeader("last-event-id")
+}
+
+// Done is closed when the stream is closed or the client has disconnected.
+func (s *EventStream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *EventStream) stop() bool {
+	if s.closed {
+		return false
+	}
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	close(s.done)
+	return true
+}
+
+func (s *EventStream) heartbeat() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.r.writeChunked([]byte(":\n\n"))
+		s.r.Flush()
+		s.timer.Reset(SSEHeartbeat)
+	}
+}
+
+// Send sends an event, event and id can be empty.
+func (s *EventStream) Send(event, id, data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return net.ErrClosed
+	}
+	b := appendEvent(s.buf[:0], event, id, data)
+	s.buf = b
+	s.r.writeChunked(b)
+	s.r.Flush()
+	if s.timer != nil {
+		s.timer.Reset(SSEHeartbeat)
+	}
+	return nil
+}
+
+// appendEvent appends the event to b, data is split into lines on "\r\n", "\r"
+// or "\n" like clients do, so it can't inject fields.
+func appendEvent(b []byte, event, id, data string) []byte {
+	if event != "" {
+		b = append(append(append(b, "event: "...), stripNewlines(event)...), '\n')
+	}
+	if id != "" {
+		b = append(append(append(b, "id: "...), stripNewlines(id)...), '\n')
+	}
+	for {
+		i := strings.IndexAny(data, "\r\n")
+		if i < 0 {
+			b = append(append(append(b, "data: "...), data...), '\n')
+			break
+		}
+		b = append(append(append(b, "data: "...), data[:i]...), '\n')
+		if data[i] == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			i++
+		}
+		data = data[i+1:]
+	}
+	return append(b, '\n')
+}
+
+// Close ends the stream, the connection is kept alive if possible.
+func (s *EventStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop() {
+		s.unhook()
+		s.r.FinishChunked()
+	}
+}
+
+func stripNewlines(s string) string {
+	if strings.ContainsAny(s, "\r\n") {
+		return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+	}
+	return s
+}
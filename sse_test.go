@@ -0,0 +1,24 @@
+package resh
+
+import "testing"
+
+func TestAppendEvent(t *testing.T) {
+	for _, tc := range []struct {
+		event, id, data string
+		want            string
+	}{
+		{"", "", "", "data: \n\n"},
+		{"", "", "x", "data: x\n\n"},
+		{"e", "1", "a\nb", "event: e\nid: 1\ndata: a\ndata: b\n\n"},
+		{"", "", "a\r\nb", "data: a\ndata: b\n\n"},
+		{"", "", "a\n", "data: a\ndata: \n\n"},
+		{"", "", "x\rid: 9\revent: admin", "data: x\ndata: id: 9\ndata: event: admin\n\n"},
+		{"", "", "x\r\rretry: 1", "data: x\ndata: \ndata: retry: 1\n\n"},
+		{"", "", "x\n\rid: 9", "data: x\ndata: \ndata: id: 9\n\n"},
+		{"a\rb", "1\r\n2", "x", "event: ab\nid: 12\ndata: x\n\n"},
+	} {
+		if got := string(appendEvent(nil, tc.event, tc.id, tc.data)); got != tc.want {
+			t.Errorf("appendEvent(%q, %q, %q) = %q, want %q", tc.event, tc.id, tc.data, got, tc.want)
+		}
+	}
+}
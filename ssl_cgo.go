@@ -7,6 +7,7 @@ package resh
 #cgo darwin LDFLAGS: -lssl -lcrypto -ldl -L/opt/homebrew/opt/openssl@3/lib
 #cgo darwin CPPFLAGS: -I/opt/homebrew/opt/openssl@3/include
 #include<string.h>
+#include<strings.h>
 #include<openssl/bio.h>
 #include<openssl/ssl.h>
 #include<openssl/err.h>
@@ -30,14 +31,69 @@ char* X_get_last_error() {
     return copy;
 }
 
-const unsigned char *default_alpn = "http/1.1";
+static const unsigned char alpn_h1[] = "\x08http/1.1";
+static const unsigned char alpn_h2[] = "\x02h2\x08http/1.1";
 
+// arg != NULL means h2 is preferred.
 int X_set_alpn_select_cb(SSL *ssl, const unsigned char **out, unsigned char *outlen, const unsigned char *in, unsigned int inlen, void *arg) {
-    *out = default_alpn;
-    *outlen = sizeof(default_alpn);
+    const unsigned char *protos = arg ? alpn_h2 : alpn_h1;
+    unsigned int len = arg ? sizeof(alpn_h2) - 1 : sizeof(alpn_h1) - 1;
+    if (SSL_select_next_proto((unsigned char **)out, outlen, protos, len, in, inlen) != OPENSSL_NPN_NEGOTIATED) {
+        return SSL_TLSEXT_ERR_NOACK;
+    }
+    return SSL_TLSEXT_ERR_OK;
+}
+
+typedef struct X_sni {
+    char *name;
+    SSL_CTX *ctx;
+    struct X_sni *next;
+} X_sni;
+
+// X_sni_cb switches to the context matching the server name, exact names
+// win over wildcards and longer wildcards win over shorter ones.
+static int X_sni_cb(SSL *ssl, int *ad, void *arg) {
+    const char *name = SSL_get_servername(ssl, TLSEXT_NAMETYPE_host_name);
+    if (name == NULL) return SSL_TLSEXT_ERR_OK;
+    size_t nl = strlen(name), best_len = 0;
+    X_sni *best = NULL;
+    for (X_sni *e = *(X_sni **)arg; e; e = e->next) {
+        if (strcasecmp(e->name, name) == 0) {
+            best = e;
+            break;
+        }
+        if (e->name[0] == '*') {
+            const char *suffix = e->name + 1;
+            size_t sl = strlen(suffix);
+            if (nl > sl && sl > best_len && strcasecmp(name + nl - sl, suffix) == 0) {
+                best = e;
+                best_len = sl;
+            }
+        }
+    }
+    if (best) SSL_set_SSL_CTX(ssl, best->ctx);
     return SSL_TLSEXT_ERR_OK;
 }
 
+void X_add_sni(SSL_CTX *ctx, const char *name, SSL_CTX *sub) {
+    X_sni **head = SSL_CTX_get_app_data(ctx);
+    if (head == NULL) {
+        head = calloc(1, sizeof(X_sni *));
+        SSL_CTX_set_app_data(ctx, head);
+        SSL_CTX_set_tlsext_servername_callback(ctx, X_sni_cb);
+        SSL_CTX_set_tlsext_servername_arg(ctx, head);
+    }
+    X_sni *e = malloc(sizeof(X_sni));
+    e->name = strdup(name);
+    e->ctx = sub;
+    e->next = *head;
+    *head = e;
+}
+
+void X_enable_h2(SSL_CTX *ctx) {
+    SSL_CTX_set_alpn_select_cb(ctx, X_set_alpn_select_cb, (void *)1);
+}
+
 X_SSL_CTX* X_init(const int is_client, const char* cert, size_t cert_len, const char* key, size_t key_len) {
     SSL_load_error_strings();
     SSL_library_init();
@@ -130,6 +186,15 @@ void X_free(SSL* ssl) {
 }
 
 void X_SSL_CTX_free(SSL_CTX *ctx) {
+    X_sni **head = SSL_CTX_get_app_data(ctx);
+    if (head) {
+        for (X_sni *e = *head, *next; e; e = next) {
+            next = e->next;
+            free(e->name);
+            free(e);
+        }
+        free(head);
+    }
     SSL_CTX_free(ctx);
 }
 */
@@ -206,6 +271,18 @@ func (ctx *SSLCtx) close() {
 	C.X_SSL_CTX_free(ctx.ctx)
 }
 
+// addSNI serves the server name with the certificate of sub.
+func (ctx *SSLCtx) addSNI(name string, sub *SSLCtx) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	C.X_add_sni(ctx.ctx, cname, sub.ctx)
+}
+
+// enableH2 lets ALPN select h2 over http/1.1.
+func (ctx *SSLCtx) enableH2() {
+	C.X_enable_h2(ctx.ctx)
+}
+
 func (s *SSL) Read(p []byte) (int, error) {
 	if !s.handshaked {
 		res := C.X_handshake(s.ssl)
@@ -26,6 +26,14 @@ func (ctx *SSLCtx) close() {
 	panic(0)
 }
 
+func (ctx *SSLCtx) addSNI(name string, sub *SSLCtx) {
+	panic(0)
+}
+
+func (ctx *SSLCtx) enableH2() {
+	panic(0)
+}
+
 func (s *SSL) Read(p []byte) (int, error) {
 	panic(0)
 }
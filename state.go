@@ -14,17 +14,29 @@ type serverReadState struct {
 
 	// 6: read all HTTP lines
 	// 7: if Content-Length exists, read the body
+	// 10: stream the body to BodyStream
 
 	// 999: end
-	stage int
-	redis *Redis
-	http  *HTTP
+	stage  int
+	redis  *Redis
+	http   *HTTP
+	body   *BodyStream // 10: the body is being streamed
+	remain int
 }
 
-func (r *serverReadState) process(in []byte) error {
+func (r *serverReadState) process(ln *Listener, in []byte) error {
 AGAIN:
 	switch r.stage {
 	case 0:
+		if ln.HTTP2 && len(in) > 0 && in[0] == 'P' {
+			if len(in) < len(h2Preface) {
+				if string(in) == h2Preface[:len(in)] {
+					return errWaitMore
+				}
+			} else if string(in[:len(h2Preface)]) == h2Preface {
+				return errH2Preface
+			}
+		}
 		num, w, err := readByteAndNumberCrLf('*', in)
 		if err != nil {
 			return err
@@ -36,7 +48,7 @@ AGAIN:
 			if num > 65535 {
 				return fmt.Errorf("too many redis arguments")
 			}
-			r.redis = &Redis{}
+			r.redis = &Redis{max: ln.redisMaxBytes()}
 			r.redis.read = uint32(w)
 			r.redis.nargs = uint16(num)
 			r.stage = 1
@@ -55,6 +67,9 @@ AGAIN:
 				return fmt.Errorf("invalid bulk string length %d", length)
 			}
 			x := int(r.redis.read) + w + int(length)
+			if x+2 > r.redis.max {
+				return &sizeError{"RESP command", x + 2, r.redis.max}
+			}
 			if len(in) < x+2 {
 				return errWaitMore
 			}
@@ -63,17 +78,32 @@ AGAIN:
 			}
 			r.redis.ai = append(r.redis.ai, [2]uint32{r.redis.read + uint32(w), uint32(length)})
 			r.redis.read += uint32(w + int(length) + 2)
+			if len(r.redis.ai) == 1 && ln.RedisCommandMaxBytes != nil {
+				name := in[r.redis.ai[0][0] : r.redis.ai[0][0]+r.redis.ai[0][1]]
+				if r.redis.max = ln.redisCommandMaxBytes(name, r.redis.max); int(r.redis.read) > r.redis.max {
+					return &sizeError{"RESP command", int(r.redis.read), r.redis.max}
+				}
+			}
 		}
 		r.stage = 999
 		r.redis.data = in[:r.redis.read]
 		return nil
 	case 6:
 		idx := bytes.Index(in, []byte("\r\n\r\n"))
+		if idx == -1 && len(in) > ln.HTTPMaxHeaderBytes || idx+4 > ln.HTTPMaxHeaderBytes {
+			if l := bytes.Index(in, crlf); l == -1 || l > ln.HTTPMaxHeaderBytes {
+				return &httpError{414, fmt.Errorf("request line too long")}
+			}
+			return &httpError{431, fmt.Errorf("request header too large")}
+		}
 		if idx == -1 {
+			if !ln.HTTPLenientParsing && bareLF(in) {
+				return &httpError{400, fmt.Errorf("bare LF in request header")}
+			}
 			return errWaitMore
 		}
 		r.http.data = in[:idx+4]
-		if err := r.http.parse(); err != nil {
+		if err := r.http.parse(ln, !ln.HTTPLenientParsing); err != nil {
 			return err
 		}
 		if r.http.bodyLen == 0 {
@@ -81,6 +111,12 @@ AGAIN:
 			return nil
 		}
 		r.stage = 7
+		if ln.OnHTTPBody != nil {
+			return errHTTPBody
+		}
+		if max := ln.maxBodyBytes(r.http); int(r.http.bodyLen) > max {
+			return &httpError{413, fmt.Errorf("request body too large: %db > %db", r.http.bodyLen, max)}
+		}
 		fallthrough
 	case 7:
 		sz := int(r.http.hdrLen + r.http.bodyLen)
@@ -0,0 +1,73 @@
+package resh
+
+import (
+	"errors"
+	"testing"
+)
+
+// Regression corpus of strict HTTP/1 parsing against request smuggling.
+func TestStrictParsing(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		req     string
+		strict  int // expected status, 0 means the connection is held waiting for more
+		lenient int
+	}{
+		{"valid", "GET /a?b=c HTTP/1.1\r\nHost: x\r\n\r\n", 200, 200},
+		{"valid 1.0 without host", "GET / HTTP/1.0\r\n\r\n", 200, 200},
+		{"valid body", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc", 200, 200},
+		{"obs-text value", "GET / HTTP/1.1\r\nHost: x\r\nX-A: caf\xc3\xa9\r\n\r\n", 200, 200},
+
+		{"duplicate content-length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc", 400, 200},
+		{"conflicting content-length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 0\r\n\r\nabc", 400, 200},
+		{"signed content-length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: +3\r\n\r\nabc", 400, 200},
+		{"list content-length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3, 3\r\n\r\nabc", 400, 400},
+		{"transfer-encoding", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", 501, 501},
+		{"te identity", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: identity\r\n\r\n", 501, 501},
+		{"content-length and te", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\nabc", 400, 400},
+		{"te and content-length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\nabc", 400, 400},
+
+		{"space before colon", "GET / HTTP/1.1\r\nHost: x\r\nContent-Length : 0\r\n\r\n", 400, 200},
+		{"tab before colon", "GET / HTTP/1.1\r\nHost: x\r\nX-A\t: b\r\n\r\n", 400, 200},
+		{"obs-fold", "GET / HTTP/1.1\r\nHost: x\r\nX-A: b\r\n c\r\n\r\n", 400, 400},
+		{"invalid header name", "GET / HTTP/1.1\r\nHost: x\r\nX(A): b\r\n\r\n", 400, 200},
+		{"control in header value", "GET / HTTP/1.1\r\nHost: x\r\nX-A: b\x00c\r\n\r\n", 400, 200},
+		{"bare CR in header", "GET / HTTP/1.1\r\nHost: x\rX-A: b\r\n\r\n", 400, 200},
+		{"bare LF line endings", "GET / HTTP/1.1\nHost: x\n\n", 400, 0},
+		{"bare LF in header", "GET / HTTP/1.1\r\nHost: x\nX-A: b\r\n\r\n", 400, 200},
+
+		{"invalid method", "G(T / HTTP/1.1\r\nHost: x\r\n\r\n", 400, 200},
+		{"control in method", "G\x01T / HTTP/1.1\r\nHost: x\r\n\r\n", 400, 200},
+		{"space in target", "GET /a b HTTP/1.1\r\nHost: x\r\n\r\n", 400, 200},
+		{"double space", "GET  / HTTP/1.1\r\nHost: x\r\n\r\n", 400, 200},
+		{"tab in target", "GET /a\tb HTTP/1.1\r\nHost: x\r\n\r\n", 400, 200},
+		{"lower-case version", "GET / http/1.1\r\nHost: x\r\n\r\n", 400, 400},
+		{"long version", "GET / HTTP/1.10\r\nHost: x\r\n\r\n", 400, 400},
+		{"HTTP/2.0 version", "GET / HTTP/2.0\r\nHost: x\r\n\r\n", 505, 505},
+
+		{"missing host", "GET / HTTP/1.1\r\n\r\n", 400, 200},
+		{"multiple host", "GET / HTTP/1.1\r\nHost: x\r\nHost: y\r\n\r\n", 400, 200},
+	} {
+		for _, lenient := range []bool{false, true} {
+			want := tc.strict
+			if lenient {
+				want = tc.lenient
+			}
+			ln := &Listener{HTTPLenientParsing: lenient}
+			testConn(ln)
+			var srs serverReadState
+			got, err := 200, srs.process(ln, []byte(tc.req))
+			var he *httpError
+			if errors.As(err, &he) {
+				got = he.code
+			} else if err == errWaitMore {
+				got = 0
+			} else if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if got != want {
+				t.Errorf("%s (lenient %v): got %d, want %d (%v)", tc.name, lenient, got, want, err)
+			}
+		}
+	}
+}
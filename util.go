@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
-	"net/http"
 	"strconv"
 	"unsafe"
 )
@@ -20,6 +19,16 @@ func (e Error) Error() string {
 
 var errWaitMore = fmt.Errorf("wait more")
 
+// httpError is returned by the parser to respond with the status code before closing the connection.
+type httpError struct {
+	code  int
+	cause error
+}
+
+func (e *httpError) Error() string {
+	return strconv.Itoa(e.code) + " " + e.cause.Error()
+}
+
 func readByteAndNumberCrLf(head byte, in []byte) (int64, int, error) {
 	if len(in) < 4 { // 1b + 1b + '\r\n'
 		return 0, 0, errWaitMore
@@ -27,8 +36,15 @@ func readByteAndNumberCrLf(head byte, in []byte) (int64, int, error) {
 	if in[0] != head {
 		return 0, 0, nil
 	}
-	idx := bytes.Index(in, []byte("\r\n"))
+	line := in
+	if len(line) > 32 {
+		line = line[:32] // more than enough for an int64
+	}
+	idx := bytes.Index(line, []byte("\r\n"))
 	if idx == -1 {
+		if len(line) == 32 {
+			return 0, 0, fmt.Errorf("invalid number line %q", line)
+		}
 		return 0, 0, errWaitMore
 	}
 	v, err := strconv.ParseInt(btos(in[1:idx]), 10, 64)
@@ -65,32 +81,17 @@ func btos(in []byte) string {
 	return unsafe.String(unsafe.SliceData(in), len(in))
 }
 
-type netHTTPResponseWriter struct {
-	code int
-	h    http.Header
-	w    bytes.Buffer
-}
-
-func (w *netHTTPResponseWriter) StatusCode() int {
-	if w.code == 0 {
-		return http.StatusOK
-	}
-	return w.code
-}
-
-func (w *netHTTPResponseWriter) Header() http.Header {
-	if w.h == nil {
-		w.h = make(http.Header)
+// bareLF reports whether in has a LF not preceded by CR.
+func bareLF(in []byte) bool {
+	for i := bytes.IndexByte(in, '\n'); i >= 0; {
+		if i == 0 || in[i-1] != '\r' {
+			return true
+		}
+		j := bytes.IndexByte(in[i+1:], '\n')
+		if j < 0 {
+			break
+		}
+		i += j + 1
 	}
-	return w.h
+	return false
 }
-
-func (w *netHTTPResponseWriter) WriteHeader(statusCode int) {
-	w.code = statusCode
-}
-
-func (w *netHTTPResponseWriter) Write(p []byte) (int, error) {
-	return w.w.Write(p)
-}
-
-func (w *netHTTPResponseWriter) Flush() {}
@@ -0,0 +1,109 @@
+package resh
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// VirtualHost serves HTTP requests to a set of host names.
+type VirtualHost struct {
+	// Names are exact host names like "example.com" or wildcard subdomains
+	// like "*.example.com", which also match deeper subdomains. Names are
+	// case-insensitive and ports are ignored.
+	Names   []string
+	Handler func(*HTTP) (more bool)
+	// CertPEM and KeyPEM are selected by SNI, the listener certificate is used if empty.
+	CertPEM []byte
+	KeyPEM  []byte
+	// MaxBodyBytes limits request bodies, 0 means Listener.HTTPMaxBodyBytes.
+	MaxBodyBytes int
+}
+
+// VirtualHosts dispatches HTTP requests by their Host, see Listener.SetVirtualHosts.
+type VirtualHosts struct {
+	hosts map[string]*VirtualHost
+	// Default serves requests matching no host, 404 is responded if nil.
+	Default *VirtualHost
+}
+
+func (vh *VirtualHosts) Add(v *VirtualHost) error {
+	if v.Handler == nil {
+		return fmt.Errorf("virtual host %v: missing handler", v.Names)
+	}
+	if vh.hosts == nil {
+		vh.hosts = map[string]*VirtualHost{}
+	}
+	for _, name := range v.Names {
+		name = normalizeHost(name)
+		if name == "" || strings.Contains(name[1:], "*") || name[0] == '*' && !strings.HasPrefix(name, "*.") {
+			return fmt.Errorf("virtual host %v: invalid name %q", v.Names, name)
+		}
+		if _, ok := vh.hosts[name]; ok {
+			return fmt.Errorf("virtual host %v: duplicated name %q", v.Names, name)
+		}
+		vh.hosts[name] = v
+	}
+	return nil
+}
+
+// Lookup returns the virtual host serving host, the most specific name wins.
+func (vh *VirtualHosts) Lookup(host string) *VirtualHost {
+	host = normalizeHost(host)
+	if v, ok := vh.hosts[host]; ok {
+		return v
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		if v, ok := vh.hosts["*"+host[i:]]; ok {
+			return v
+		}
+		j := strings.IndexByte(host[i+1:], '.')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return vh.Default
+}
+
+func (vh *VirtualHosts) serve(r *HTTP) bool {
+	if v := vh.Lookup(r.Host); v != nil {
+		return v.Handler(r)
+	}
+	r.Text(404, "unknown host")
+	return true
+}
+
+// normalizeHost strips the port and the trailing dot, and lowercases the host.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// SetVirtualHosts dispatches HTTP requests to vh and installs certificates
+// of virtual hosts for SNI. LoadCertPEMs must be called first to serve TLS.
+func (ln *Listener) SetVirtualHosts(vh *VirtualHosts) error {
+	loaded := map[*VirtualHost]bool{}
+	for _, v := range vh.hosts {
+		if len(v.CertPEM) == 0 || loaded[v] {
+			continue
+		}
+		loaded[v] = true
+		if ln.sslCtx == nil {
+			return fmt.Errorf("virtual host %v: LoadCertPEMs must be called first", v.Names)
+		}
+		ctx, err := sslNewCtx(v.CertPEM, v.KeyPEM)
+		if err != nil {
+			return fmt.Errorf("virtual host %v: %v", v.Names, err)
+		}
+		ln.sniCtxs = append(ln.sniCtxs, ctx)
+		for _, name := range v.Names {
+			ln.sslCtx.addSNI(normalizeHost(name), ctx)
+		}
+	}
+	ln.vhosts = vh
+	ln.OnHTTP = vh.serve
+	return nil
+}
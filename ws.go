@@ -11,6 +11,8 @@ type Websocket struct {
 	contFrame   []byte
 	closed      bool
 	closingData []byte
+	max         int          // size limit of messages
+	log         *AccessEntry // the session
 }
 
 type wsFrame struct {
@@ -28,8 +30,8 @@ func (s *Listener) onWebsocket(req wsFrame, c *Conn) bool {
 			return false
 		}
 		c.ws.contFrame = append(c.ws.contFrame, req.data...)
-		if len(c.ws.contFrame) > RequestMaxBytes {
-			s.closeConnWithError(c, "websocket", fmt.Errorf("continuation frame too large"))
+		if len(c.ws.contFrame) > c.ws.max {
+			s.tooLarge(c, &sizeError{"websocket message", len(c.ws.contFrame), c.ws.max})
 			return false
 		}
 		if req.fin {
@@ -61,35 +63,29 @@ func (ws *Websocket) parse(in []byte) error {
 
 	var size = int(in[1] & 0x7f)
 	var off int
-	var mask []byte
 	switch size {
 	case 126:
 		if len(in) < 2+2+4 {
 			return errWaitMore
 		}
 		size = int(binary.BigEndian.Uint16(in[2:]))
-		if len(in) < 2+2+4+size {
-			return errWaitMore
-		}
-		mask = in[4:8]
 		off = 8
 	case 127:
-		if len(in) < 2+2+6+4 {
+		if len(in) < 2+8+4 {
 			return errWaitMore
 		}
 		size = int(binary.BigEndian.Uint64(in[2:]))
-		if len(in) < 2+2+6+4+size {
-			return errWaitMore
-		}
-		mask = in[10:14]
 		off = 14
 	default:
-		if len(in) < 2+4+size {
-			return errWaitMore
-		}
-		mask = in[2:6]
 		off = 6
 	}
+	if size < 0 || size > ws.max {
+		return &sizeError{"websocket message", size, ws.max}
+	}
+	if len(in) < off+size {
+		return errWaitMore
+	}
+	mask := in[off-4 : off]
 	f.len = off + size
 	f.data = in[off : off+size]
 	for i := range f.data {
@@ -109,16 +105,7 @@ func (ws *Websocket) WriteBinary(p []byte) {
 }
 
 func (ws *Websocket) write(typ byte, p string) {
-	var tmp []byte
-	tmp = append(tmp, 0x80|typ)
-	if len(p) < 126 {
-		tmp = append(tmp, byte(len(p)))
-	} else if len(p) < 65536 {
-		v := uint16(len(p))
-		tmp = append(tmp, 126, byte(v>>8), byte(v))
-	} else {
-		tmp = binary.BigEndian.AppendUint64(append(tmp, 127), uint64(len(p)))
-	}
+	tmp := wsFrameHeader(nil, typ, len(p))
 	tmp = append(tmp, p...)
 	ws.Conn.Write(tmp)
 	ws.Conn.Flush()